@@ -20,8 +20,8 @@ exit /b 0
     rmdir /q/s easymesh
     mkdir easymesh
 
-    go build -ldflags="-w -s" -o easymesh\transfer%TAG% transfer\main.go
-    go build -ldflags="-w -s" -o easymesh\gateway%TAG% gateway\main.go
+    go build -ldflags="-w -s" -o easymesh\transfer%TAG% .\transfer
+    go build -ldflags="-w -s" -o easymesh\gateway%TAG% .\gateway
 
     tar -zcf easymesh_%GOOS%_%GOARCH%.tar.gz easymesh
 	rmdir /q/s easymesh
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/route"
+	"github.com/easymesh/easymesh/util/ip"
+	"net"
+	"sync"
+)
+
+var defaultNet = ip.IP4Net{IP: ip.IP4(0), PrefixLen: 0}
+
+// the default route is split in two halves, so it wins over the
+// existing default route without replacing it
+var defaultHalves = []ip.IP4Net{
+	{IP: ip.MustParseIP4("0.0.0.0"), PrefixLen: 1},
+	{IP: ip.MustParseIP4("128.0.0.0"), PrefixLen: 1},
+}
+
+var exitNode ip.IP4
+
+func initExit(exit bool, useExit string) error {
+	var err error
+
+	if exit {
+		err = masqueradeAdd(overlayNet.Network(), inface.Name)
+		if err != nil {
+			return fmt.Errorf("exit node init fail, %s", err.Error())
+		}
+		logs.Info("exit node masquerade %s out of %s", overlayNet.Network().String(), inface.Name)
+	}
+
+	if useExit == "" {
+		return nil
+	}
+
+	// without host routes over the underlay the default route would
+	// take the transfer and the peers into the tunnel
+	if BYPASS_ROUTE == false {
+		return fmt.Errorf("default route through exit node is not supported on this platform")
+	}
+
+	exitNode, err = ip.ParseIP4(useExit)
+	if err != nil {
+		return fmt.Errorf("exit node %s is invalid, %s", useExit, err.Error())
+	}
+
+	for _, t := range transfers {
+		dst := t.UnderlayIP()
+		if dst == nil || dst.IsLoopback() {
+			continue
+		}
+		err = bypassCtrl.Add(dst)
+		if err != nil {
+			exitNode = ip.IP4(0)
+			return fmt.Errorf("host route to transfer fail, %s", err.Error())
+		}
+	}
+	routeCtrl.SetExit(exitNode)
+
+	for _, v := range defaultHalves {
+		err = tunHandler.AddRoute(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	logs.Info("default route through exit node %s", exitNode.String())
+	return nil
+}
+
+// keep reaching the transfer over the underlay, otherwise the tunnel
+// would be routed into itself; the transfer may move on reconnect, so
+// this is done each time before it is contacted
+func bypassTransfer(dst net.IP)  {
+	if exitNode == ip.IP4(0) || dst == nil || dst.IsLoopback() {
+		return
+	}
+	err := bypassCtrl.Add(dst)
+	if err != nil {
+		logs.Error("host route to transfer fail", err.Error())
+	}
+}
+
+func closeExit()  {
+	if EXIT_NODE {
+		err := masqueradeDel(overlayNet.Network(), inface.Name)
+		if err != nil {
+			logs.Error(err.Error())
+		}
+	}
+	bypassCtrl.Clean()
+}
+
+// host routes over the underlay for the transfer and the public paths
+// to peers, while the default route points into the mesh
+type BypassCtrl struct {
+	sync.Mutex
+	installed map[string]*bypassRoute
+}
+
+var bypassCtrl = &BypassCtrl{installed: make(map[string]*bypassRoute, 64)}
+
+// only the ipv4 default route points into the mesh, ipv6 destinations
+// keep their route and need none
+func (ctrl *BypassCtrl)Add(dst net.IP) error {
+	if dst.To4() == nil {
+		return nil
+	}
+
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	if _, ok := ctrl.installed[dst.String()]; ok {
+		return nil
+	}
+
+	r, err := bypassAdd(dst)
+	if err != nil {
+		return err
+	}
+	ctrl.installed[dst.String()] = r
+
+	logs.Info("install bypass host route %s", dst.String())
+	return nil
+}
+
+func (ctrl *BypassCtrl)Clean()  {
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	for k, v := range ctrl.installed {
+		err := bypassDel(v)
+		if err != nil {
+			logs.Error("remove bypass host route %s fail, %s", k, err.Error())
+		}
+		delete(ctrl.installed, k)
+	}
+}
+
+func SyncBypass()  {
+	if exitNode == ip.IP4(0) {
+		return
+	}
+
+	for _, r := range routeCtrl.Export() {
+		for _, v := range r.Udp {
+			if v.Typ != route.UDP_THROUGH_T && v.Typ != route.UDP_PUNCH_T {
+				continue
+			}
+			err := bypassCtrl.Add(v.Udp.IP)
+			if err != nil {
+				logs.Error("install bypass host route fail", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"github.com/easymesh/easymesh/util/ip"
+	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+const tunIfacePattern = "mesh+"
+
+func iptables(args ...string) error {
+	output, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s fail, %s %s", strings.Join(args, " "), err.Error(), string(output))
+	}
+	return nil
+}
+
+func masqueradeRules(src ip.IP4Net, oif string) [][]string {
+	return [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", src.String(), "-o", oif, "-j", "MASQUERADE"},
+		{"FORWARD", "-i", tunIfacePattern, "-o", oif, "-j", "ACCEPT"},
+		{"FORWARD", "-i", oif, "-o", tunIfacePattern, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+}
+
+func ruleArgs(action string, rule []string) []string {
+	if rule[0] == "-t" {
+		return append([]string{rule[0], rule[1], action}, rule[2:]...)
+	}
+	return append([]string{action}, rule...)
+}
+
+const IP_FORWARD = "/proc/sys/net/ipv4/ip_forward"
+
+// the ip forward setting found before the exit node turned it on, put
+// back on close
+var ipForward []byte
+
+func masqueradeAdd(src ip.IP4Net, oif string) error {
+	old, err := ioutil.ReadFile(IP_FORWARD)
+	if err != nil {
+		return fmt.Errorf("read ip forward fail, %s", err.Error())
+	}
+	if ipForward == nil {
+		ipForward = old
+	}
+
+	err = ioutil.WriteFile(IP_FORWARD, []byte("1"), 0644)
+	if err != nil {
+		return fmt.Errorf("enable ip forward fail, %s", err.Error())
+	}
+
+	for _, rule := range masqueradeRules(src, oif) {
+		if iptables(ruleArgs("-C", rule)...) == nil {
+			continue
+		}
+		err = iptables(ruleArgs("-A", rule)...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func masqueradeDel(src ip.IP4Net, oif string) error {
+	var lastErr error
+	for _, rule := range masqueradeRules(src, oif) {
+		err := iptables(ruleArgs("-D", rule)...)
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	if ipForward != nil {
+		err := ioutil.WriteFile(IP_FORWARD, ipForward, 0644)
+		if err != nil {
+			lastErr = fmt.Errorf("restore ip forward fail, %s", err.Error())
+		}
+		ipForward = nil
+	}
+	return lastErr
+}
+
+const BYPASS_ROUTE = true
+
+// the host route as installed, it is removed the same way
+type bypassRoute = netlink.Route
+
+var underlayRoute *netlink.Route
+
+func meshLink(index int) bool {
+	link, err := netlink.LinkByIndex(index)
+	return err == nil && strings.HasPrefix(link.Attrs().Name, strings.TrimSuffix(tunIfacePattern, "+"))
+}
+
+// host route through whatever the underlay takes to the destination;
+// once the default route points into the mesh the lookup ends in the
+// tunnel, the underlay route found first is taken then
+func bypassAdd(dst net.IP) (*bypassRoute, error) {
+	via := underlayRoute
+	routes, err := netlink.RouteGet(dst)
+	if err == nil && len(routes) > 0 && meshLink(routes[0].LinkIndex) == false {
+		via = &routes[0]
+		if underlayRoute == nil {
+			underlayRoute = via
+		}
+	}
+	if via == nil {
+		return nil, fmt.Errorf("no underlay route to %s", dst.String())
+	}
+
+	r := &netlink.Route{
+		LinkIndex: via.LinkIndex,
+		Gw:        via.Gw,
+		Dst:       &net.IPNet{IP: dst.To4(), Mask: net.CIDRMask(32, 32)},
+	}
+	err = netlink.RouteReplace(r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func bypassDel(r *bypassRoute) error {
+	return netlink.RouteDel(r)
+}
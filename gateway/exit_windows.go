@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"github.com/easymesh/easymesh/util/ip"
+	"net"
+)
+
+// host routes over the underlay are not installed on windows
+const BYPASS_ROUTE = false
+
+func masqueradeAdd(src ip.IP4Net, oif string) error {
+	return fmt.Errorf("exit node is not supported on windows")
+}
+
+func masqueradeDel(src ip.IP4Net, oif string) error {
+	return nil
+}
+
+type bypassRoute struct{}
+
+func bypassAdd(dst net.IP) (*bypassRoute, error) {
+	return nil, fmt.Errorf("default route through exit node is not supported on windows")
+}
+
+func bypassDel(r *bypassRoute) error {
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/util/ip"
+	"github.com/easymesh/easymesh/util/tun"
+	"net"
+)
+
+var selfOverIP6 ip.IP6
+var overlayNet6 *net.IPNet
+
+// the ipv6 overlay address rides along the ipv4 one, frames stay
+// addressed by the ipv4 node address
+func initIP6(cidr string) error {
+	if cidr == "" {
+		return nil
+	}
+
+	addr, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("ipv6 overlay address %s is invalid, %s", cidr, err.Error())
+	}
+	if addr.To4() != nil {
+		return fmt.Errorf("%s is not an ipv6 address", cidr)
+	}
+
+	err = tunHandler.AddAddr6(&net.IPNet{IP: addr, Mask: ipnet.Mask})
+	if err != nil {
+		return err
+	}
+
+	selfOverIP6 = ip.IP6(addr.To16())
+	overlayNet6 = ipnet
+
+	logs.Info("tun ipv6 address %s", cidr)
+	return nil
+}
+
+func SendUnreachable6(tun tun.TunApi, off_iph *ip.IP6Header, offender []byte) error {
+	body, err := ip.ICMP6Unreachable(selfOverIP6, off_iph, offender)
+	if err != nil {
+		return err
+	}
+	err = tun.Write(body)
+	if err != nil {
+		return fmt.Errorf("send ICMPv6 no route to tun fail, %s", err.Error())
+	}
+	return nil
+}
+
+// owner and next hop of an ipv6 packet read from the tun, nil next hop
+// means the packet is dropped
+func TunRoute6(tun tun.TunApi, pkt []byte) (ip.IP4, net.Addr) {
+	if len(selfOverIP6) == 0 {
+		return 0, nil
+	}
+
+	ip6hdr := ip.IP6HeaderDecoder(pkt)
+	if ip6hdr == nil {
+		logs.Error("tun read ipv6 length too smail", len(pkt))
+		return 0, nil
+	}
+
+	// neighbour and router discovery stay on the local link
+	dst := net.IP(ip6hdr.DAddr)
+	if dst.IsMulticast() || dst.IsLinkLocalUnicast() {
+		return 0, nil
+	}
+
+	var peer ip.IP4
+	var dstAddr net.Addr
+
+	e := routeCtrl.Lookup6(ip6hdr.DAddr)
+	if e != nil && e.Route.IP != selfOverIP {
+		peer = e.Route.IP
+		dstAddr = findRoute(peer)
+	}
+	if dstAddr == nil {
+		err := SendUnreachable6(tun, ip6hdr, pkt)
+		if err != nil {
+			logs.Error("send unreachable fail", ip6hdr.String(), err.Error())
+		}
+		return 0, nil
+	}
+
+	err := ip6hdr.DecrementHopLimit()
+	if err != nil {
+		logs.Warn("ipv6 packet hop limit is zero", ip6hdr.String(), err.Error())
+		return 0, nil
+	}
+	ip6hdr.Coder(pkt)
+
+	return peer, dstAddr
+}
+
+// a peer may only send from its own ipv6 overlay address toward ours
+func CheckSubnet6(frameHdr *ip.FrameHeader, ip6hdr *ip.IP6Header) error {
+	if len(selfOverIP6) == 0 || ip6hdr.DAddr.Equal(selfOverIP6) == false {
+		return fmt.Errorf("destination %s is not us", ip6hdr.DAddr.String())
+	}
+
+	e := routeCtrl.Lookup6(ip6hdr.SAddr)
+	if e == nil || e.Route.IP != frameHdr.SAddr {
+		return fmt.Errorf("source %s is not owned by %s", ip6hdr.SAddr.String(), frameHdr.SAddr.String())
+	}
+	return nil
+}
+
+func UdpDeliver6(tun tun.TunApi, frameHdr *ip.FrameHeader, body []byte) error {
+	ip6hdr := ip.IP6HeaderDecoder(body)
+	if ip6hdr == nil {
+		return fmt.Errorf("sealed frame carry bad ipv6 packet %s", frameHdr.String())
+	}
+
+	err := CheckSubnet6(frameHdr, ip6hdr)
+	if err != nil {
+		return err
+	}
+
+	err = ip6hdr.DecrementHopLimit()
+	if err != nil {
+		return err
+	}
+	ip6hdr.Coder(body)
+
+	return tun.Write(body)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/route"
+	"github.com/easymesh/easymesh/util/ip"
+	"github.com/easymesh/easymesh/util/udp"
+	"time"
+)
+
+// the virtual address and its network, from -ip or leased from the
+// transfers when -ip is empty
+func initAddress(conn udp.Transport, addr string) (*ip.IP4Net, error) {
+	if addr != "" {
+		return ip.NewIP4Net(addr, 16)
+	}
+
+	lease := leaseAddress(conn)
+	OVER_IP = lease.IP.String()
+
+	logs.Info("virtual ip %s leased from pool %s", OVER_IP, lease.Net.String())
+	return &ip.IP4Net{IP: lease.IP, PrefixLen: lease.Net.PrefixLen}, nil
+}
+
+// ask the transfers in -trans order until one hands out an address; the
+// lease is keyed by the node public key, so a node keeps its address
+// across restarts
+func leaseAddress(conn udp.Transport) *route.Lease {
+	var backoff time.Duration
+	for  {
+		for _, t := range transfers {
+			var lease *route.Lease
+			err := t.reach(func() error {
+				var err error
+				lease, err = t.lease(conn)
+				return err
+			})
+			if err == nil {
+				return lease
+			}
+			logs.Error("lease from transfer %s fail, %s", t.name, err.Error())
+		}
+
+		backoff *= 2
+		if backoff == 0 {
+			backoff = TRANS_BACKOFF_MIN
+		} else if backoff > TRANS_BACKOFF_MAX {
+			backoff = TRANS_BACKOFF_MAX
+		}
+		logs.Warn("no virtual ip leased, retry in %s", backoff.String())
+		time.Sleep(backoff)
+	}
+}
+
+func (t *TransferCtrl)lease(conn udp.Transport) (*route.Lease, error) {
+	var lease *route.Lease
+
+	req := &route.Lease{PubKey: keyPair.PublicKey()}
+	err := t.request(conn, func(proto byte) []byte {
+		return CtrlCoder(proto, udp.MSG_LEASE, req.Coder())
+	}, func(msg *udp.Msg) (bool, error) {
+		if msg.Type != udp.MSG_LEASE {
+			return false, nil
+		}
+
+		body, err := CtrlDecoder(t.name, msg)
+		if err != nil {
+			logs.Error("lease from transfer fail", err.Error())
+			return false, nil
+		}
+
+		lease = route.LeaseDecoder(body)
+		if lease == nil || bytes.Equal(lease.PubKey, req.PubKey) == false {
+			return false, nil
+		}
+		if lease.IP == ip.IP4(0) || lease.Net.Contains(lease.IP) == false {
+			return false, fmt.Errorf("transfer %s has no address to lease", t.name)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// register once before the tun comes up, so an address held by another
+// node is found out early; without any transfer answering we go on
+func claimAddress(conn udp.Transport) error {
+	for _, t := range transfers {
+		err := t.reach(func() error {
+			return t.claim(conn)
+		})
+		if err == nil {
+			return nil
+		}
+		if _, refused := err.(*route.Error); refused {
+			return fmt.Errorf("transfer %s refuses %s", t.name, err.Error())
+		}
+		logs.Error("register with transfer %s fail, %s", t.name, err.Error())
+	}
+	logs.Warn("no transfer answers, virtual ip %s is not checked", OVER_IP)
+	return nil
+}
+
+func (t *TransferCtrl)claim(conn udp.Transport) error {
+	reg := &route.Register{Route: *LocalRoute()}
+	return t.request(conn, func(proto byte) []byte {
+		return t.registerCoder(proto, reg)
+	}, func(msg *udp.Msg) (bool, error) {
+		if msg.Type == udp.MSG_ERROR {
+			refuse := t.decodeError(msg)
+			if refuse != nil && refuse.Code == route.ERROR_KEY_PROOF {
+				t.reprove(conn, msg.Version, refuse, reg)
+				return false, nil
+			}
+			if refuse != nil && refuse.IP == selfOverIP {
+				return false, refuse
+			}
+			return false, nil
+		}
+		if msg.Type != udp.MSG_ROUTE_UPDATE && msg.Type != udp.MSG_ROUTE_DELTA {
+			return false, nil
+		}
+
+		// the routes are taken when the transfer task connects
+		_, err := CtrlDecoder(t.name, msg)
+		if err != nil {
+			logs.Error("claim answer from transfer fail", err.Error())
+			return false, nil
+		}
+		t.Lock()
+		t.protoSet(msg.Version)
+		t.Unlock()
+		return true, nil
+	})
+}
+
+func (t *TransferCtrl)decodeError(msg *udp.Msg) *route.Error {
+	body, err := CtrlDecoder(t.name, msg)
+	if err != nil {
+		logs.Error("error from transfer fail", err.Error())
+		return nil
+	}
+	return route.ErrorDecoder(body)
+}
+
+// a register refused for its key proof goes again at once, proven
+// toward the key the transfer told; a transfer telling of key proofs
+// speaks the versioned format. Nothing goes again when the key is the
+// one proven toward already, so a proof failing anyway does not loop
+func (t *TransferCtrl)reprove(conn udp.Transport, version byte, refuse *route.Error, reg *route.Register)  {
+	if t.pubKeySet(refuse.PubKey) == false && version != 0 {
+		logs.Warn("transfer %s refuses %s", t.name, refuse.Error())
+		return
+	}
+	addr := t.Addr()
+	if addr == nil {
+		return
+	}
+	err := conn.WriteTo(t.registerCoder(udp.MSG_VERSION, reg), addr)
+	if err != nil {
+		logs.Error("udp send fail", err.Error())
+	}
+}
+
+// the transfer refused a request at runtime, the node holding the
+// address has to go before this one gets through
+func ProcessError(t *TransferCtrl, msg *udp.Msg)  {
+	refuse := t.decodeError(msg)
+	if refuse == nil {
+		return
+	}
+	if refuse.Code == route.ERROR_KEY_PROOF {
+		reg := &route.Register{Route: *LocalRoute()}
+		reg.TransRTT = t.rtt.RTT()
+		reg.Epoch, reg.Known = t.syncFrom()
+		t.reprove(udpHander, msg.Version, refuse, reg)
+		return
+	}
+	logs.Error("transfer %s refuses %s", t.name, refuse.Error())
+}
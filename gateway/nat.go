@@ -0,0 +1,170 @@
+package main
+
+import (
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/route"
+	"github.com/easymesh/easymesh/util/crypt"
+	"github.com/easymesh/easymesh/util/udp"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	PROBE_TIMEOUT = 2 * time.Second
+	PROBE_RETRY   = 3
+)
+
+type NatCtrl struct {
+	sync.Mutex
+	typ     route.NAT_TYPE
+	waiters map[uint64]chan *probeReply
+}
+
+// a probe answer with the address it came from
+type probeReply struct {
+	*route.Probe
+	from net.Addr
+}
+
+var natCtrl = &NatCtrl{waiters: make(map[uint64]chan *probeReply, 16)}
+
+func (ctrl *NatCtrl)Type() route.NAT_TYPE {
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	return ctrl.typ
+}
+
+func (ctrl *NatCtrl)typeSet(typ route.NAT_TYPE)  {
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	ctrl.typ = typ
+}
+
+func (ctrl *NatCtrl)wait(seq uint64) chan *probeReply {
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	ch := make(chan *probeReply, 1)
+	ctrl.waiters[seq] = ch
+	return ch
+}
+
+func (ctrl *NatCtrl)done(seq uint64) chan *probeReply {
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	ch, _ := ctrl.waiters[seq]
+	delete(ctrl.waiters, seq)
+	return ch
+}
+
+// the probe answers may come from any port of the transfer or from its
+// cluster peers, they are accepted by authentication alone
+func ProcessProbe(srcAddr net.Addr, msg *udp.Msg)  {
+	body, err := CtrlDecoder(srcAddr.String(), msg)
+	if err != nil {
+		logs.Error("probe from transfer fail", srcAddr.String(), err.Error())
+		return
+	}
+
+	probe := route.ProbeDecoder(body)
+	if probe == nil || probe.Mapped == nil {
+		return
+	}
+
+	ch := natCtrl.done(probe.Seq)
+	if ch != nil {
+		ch <- &probeReply{Probe: probe, from: srcAddr}
+	}
+}
+
+func probeOnce(conn udp.Transport, dst *net.UDPAddr, proto byte, alt bool, peer bool) *probeReply {
+	for i := 0; i < PROBE_RETRY; i++ {
+		probe := &route.Probe{Seq: crypt.NextSequence(), Alt: alt, Peer: peer}
+		ch := natCtrl.wait(probe.Seq)
+
+		err := conn.WriteTo(CtrlCoder(proto, udp.MSG_PROBE, probe.Coder()), dst)
+		if err != nil {
+			logs.Error("udp send nat probe fail", err.Error())
+		}
+
+		select {
+		case reply := <-ch:
+			return reply
+		case <-time.After(PROBE_TIMEOUT):
+			natCtrl.done(probe.Seq)
+		}
+	}
+	return nil
+}
+
+// the answer came from a host the gateway never sent to
+func otherHost(from net.Addr, transAddr *net.UDPAddr) bool {
+	addr, ok := from.(*net.UDPAddr)
+	return ok && addr.IP.Equal(transAddr.IP) == false
+}
+
+// classify the nat in front of the gateway socket by probing the
+// transfer instance on the port it announces next to it; a full cone is
+// told by a cluster peer on another host answering, without peers it is
+// reported as restricted, without a port announced a symmetric nat is
+// not told apart either
+func DetectNat(conn udp.Transport, transAddr *net.UDPAddr, proto byte) route.NAT_TYPE {
+	mapped := probeOnce(conn, transAddr, proto, false, false)
+	if mapped == nil {
+		logs.Warn("nat probe to %s no answer", transAddr.String())
+		return route.NAT_UNKNOWN
+	}
+
+	logs.Info("nat mapped address %s", mapped.Mapped.String())
+
+	if mapped.Mapped.IP.Equal(localUdpAddr.Udp.IP) {
+		return route.NAT_NONE
+	}
+
+	// filtering goes first, afterwards the neighbour port has been
+	// contacted and the nat would let its answers through
+	typ := route.NAT_PORT_RESTRICTED
+	if mapped.Cluster {
+		peer := probeOnce(conn, transAddr, proto, false, true)
+		if peer != nil && peer.Peer && otherHost(peer.from, transAddr) {
+			logs.Info("nat probe answered by peer %s", peer.from.String())
+			typ = route.NAT_FULL_CONE
+		}
+	}
+	if typ != route.NAT_FULL_CONE {
+		filter := probeOnce(conn, transAddr, proto, true, false)
+		if filter != nil && filter.Alt {
+			typ = route.NAT_RESTRICTED
+		}
+	}
+
+	if mapped.AltPort == 0 {
+		logs.Info("transfer %s announces no alt port", transAddr.String())
+		return typ
+	}
+	altAddr := *transAddr
+	altAddr.Port = mapped.AltPort
+
+	other := probeOnce(conn, &altAddr, proto, false, false)
+	if other != nil && other.Mapped.String() != mapped.Mapped.String() {
+		logs.Info("nat mapped address %s from %s", other.Mapped.String(), altAddr.String())
+		return route.NAT_SYMMETRIC
+	}
+	return typ
+}
+
+func InitNat(conn udp.Transport, t *TransferCtrl)  {
+	transAddr := t.UdpAddr()
+	if transAddr == nil {
+		logs.Info("nat type detect skipped, transfer is reached by stream")
+		return
+	}
+
+	typ := DetectNat(conn, transAddr, t.Proto())
+	natCtrl.typeSet(typ)
+	logs.Info("nat type detect %s", typ.String())
+}
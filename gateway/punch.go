@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/route"
+	"github.com/easymesh/easymesh/util/crypt"
+	"github.com/easymesh/easymesh/util/ip"
+	"github.com/easymesh/easymesh/util/udp"
+	"sync"
+	"time"
+)
+
+const (
+	PUNCH_INTERVAL = 30 * time.Second
+	PUNCH_WINDOW   = 10 * time.Second
+	PUNCH_BURST    = 10
+)
+
+type PunchCtrl struct {
+	sync.Mutex
+	request map[ip.IP4]time.Time
+	active  map[ip.IP4]time.Time
+}
+
+var punchCtrl = &PunchCtrl{
+	request: make(map[ip.IP4]time.Time, 1024),
+	active:  make(map[ip.IP4]time.Time, 1024),
+}
+
+func (ctrl *PunchCtrl)allowRequest(peer ip.IP4) bool {
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	last, _ := ctrl.request[peer]
+	if time.Since(last) < PUNCH_INTERVAL {
+		return false
+	}
+	ctrl.request[peer] = time.Now()
+	return true
+}
+
+func (ctrl *PunchCtrl)start(peer ip.IP4)  {
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	ctrl.active[peer] = time.Now()
+}
+
+// a pong from an address we did not know about is accepted as the
+// punched path while a punch toward that peer is in progress
+func (ctrl *PunchCtrl)Punching(peer ip.IP4) bool {
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	begin, _ := ctrl.active[peer]
+	return time.Since(begin) < PUNCH_WINDOW
+}
+
+func directUsable(r *route.Route) bool {
+	for _, v := range r.Udp {
+		if v.Typ != route.UDP_TRANSFER_T && v.Usability() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ask the transfer to coordinate a hole punch with a peer that has no
+// direct path yet
+func RequestPunch(conn udp.Transport, r *route.Route)  {
+	if streamMode() || directUsable(r) {
+		return
+	}
+
+	if route.PunchWorth(natCtrl.Type(), r.Nat) == false {
+		logs.Debug("skip punch with %s, nat %s <-> %s", r.IP.String(),
+			natCtrl.Type().String(), r.Nat.String())
+		return
+	}
+
+	if punchCtrl.allowRequest(r.IP) == false {
+		return
+	}
+
+	t := currentTransfer()
+	if t == nil || t.Addr() == nil {
+		return
+	}
+
+	punch := &route.Punch{From: selfOverIP, To: r.IP}
+
+	logs.Info("request punch with %s", r.IP.String())
+
+	err := conn.WriteTo(CtrlCoder(t.Proto(), udp.MSG_PUNCH, punch.Coder()), t.Addr())
+	if err != nil {
+		logs.Error("udp send punch request fail", err.Error())
+	}
+}
+
+func ProcessPunch(conn udp.Transport, t *TransferCtrl, msg *udp.Msg)  {
+	body, err := CtrlDecoder(t.name, msg)
+	if err != nil {
+		logs.Error("punch from transfer fail", err.Error())
+		return
+	}
+
+	punch := route.PunchDecoder(body)
+	if punch == nil || punch.To != selfOverIP || punch.Addr == nil {
+		logs.Error("drop bad punch notice", string(body))
+		return
+	}
+
+	logs.Info("punch toward %s at %s", punch.From.String(), punch.Addr.String())
+
+	proto := peerProto(punch.From)
+	if proto == 0 {
+		logs.Warn("skip punch toward %s, it speaks the deprecated format", punch.From.String())
+		return
+	}
+	punchCtrl.start(punch.From)
+
+	go func() {
+		for i := 0; i < PUNCH_BURST; i++ {
+			output := BuildPing(proto, PING_TYPE, crypt.NextSequence(), time.Now(), punch.From)
+			err := conn.WriteTo(output, punch.Addr)
+			if err != nil {
+				logs.Error("udp send punch ping fail", err.Error())
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+	}()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/util/ip"
+	"github.com/easymesh/easymesh/util/udp"
+	"net"
+	"sync"
+	"time"
+)
+
+// frames for other gateways are passed on by the frame header only,
+// the payload stays sealed end to end; only members of the mesh get
+// relayed
+func ForwardFrame(conn udp.Transport, srcAddr net.Addr, buff []byte) bool {
+	hdr := ip.FrameHeaderDecoder(buff)
+	if hdr == nil || hdr.DAddr == selfOverIP {
+		return false
+	}
+
+	src := routeCtrl.Lookup(hdr.SAddr)
+	if src == nil || src.Route.IP != hdr.SAddr {
+		logs.Warn("drop frame relay from unknown source", hdr.String(), srcAddr.String())
+		return true
+	}
+
+	// relays never chain through another relay gateway, so frames do not
+	// bounce between two gateways proposing each other
+	e := routeCtrl.Lookup(hdr.DAddr)
+	if e == nil || e.Route.IP != hdr.DAddr {
+		logs.Warn("drop frame relay without route", hdr.String())
+		return true
+	}
+	dstAddr := currentTransAddr()
+	path := e.Route.PathUdpAddr()
+	if path != nil {
+		dstAddr = &path.Udp
+	}
+	if dstAddr == nil {
+		logs.Warn("drop frame relay without path", hdr.String())
+		return true
+	}
+
+	err := hdr.DecrementTTL()
+	if err != nil {
+		logs.Warn("frame relay ttl is zero", hdr.String(), err.Error())
+		return true
+	}
+	hdr.Coder(buff[:ip.MAX_FRAMEHEADER])
+
+	err = conn.WriteTo(buff, dstAddr)
+	if err != nil {
+		logs.Error("udp relay fail", dstAddr.String(), err.Error())
+	}
+	return true
+}
+
+// round trip of route updates to the transfer, reported so that the
+// transfer only proposes a relay gateway when it is the faster path
+type TransRTT struct {
+	sync.Mutex
+	sendAt time.Time
+	srtt   time.Duration
+}
+
+func (t *TransRTT)Send()  {
+	t.Lock()
+	defer t.Unlock()
+
+	t.sendAt = time.Now()
+}
+
+func (t *TransRTT)Recv()  {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.sendAt.IsZero() {
+		return
+	}
+	rtt := time.Since(t.sendAt)
+	t.sendAt = time.Time{}
+
+	if t.srtt == 0 {
+		t.srtt = rtt
+	} else {
+		t.srtt = (7 * t.srtt + rtt) / 8
+	}
+}
+
+func (t *TransRTT)RTT() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.srtt
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/util/crypt"
+	"github.com/easymesh/easymesh/util/ip"
+	"github.com/easymesh/easymesh/util/udp"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	HANDSHAKE_INIT = 1
+	HANDSHAKE_RESP = 2
+)
+
+const (
+	HANDSHAKE_RETRY = 5 * time.Second
+	REKEY_AFTER     = 2 * time.Minute
+	REJECT_AFTER    = 3 * time.Minute
+)
+
+type PeerSession struct {
+	cur       *crypt.Session
+	prev      *crypt.Session
+	created   time.Time
+
+	pending   *crypt.Handshake
+	pendingAt time.Time
+
+	lastInit  uint64
+}
+
+type SessionCtrl struct {
+	sync.RWMutex
+	list map[ip.IP4]*PeerSession
+}
+
+var sessionCtrl = &SessionCtrl{list: make(map[ip.IP4]*PeerSession, 1024)}
+
+var keyPair *crypt.KeyPair
+
+func initKeyPair(filename string) error {
+	var err error
+	keyPair, err = crypt.LoadKeyPair(filename)
+	if err != nil {
+		return err
+	}
+	logs.Info("node key pair load from %s", filename)
+	return nil
+}
+
+// returns the current session toward the peer and whether the caller
+// should start a new handshake, because there is none or it is stale
+func (ctrl *SessionCtrl)Session(peer ip.IP4) (*crypt.Session, bool) {
+	ctrl.RLock()
+	defer ctrl.RUnlock()
+
+	ps, _ := ctrl.list[peer]
+	if ps == nil || ps.cur == nil {
+		return nil, true
+	}
+
+	age := time.Since(ps.created)
+	if age > REJECT_AFTER {
+		return nil, true
+	}
+	return ps.cur, age > REKEY_AFTER
+}
+
+// the previous session stays usable for receiving, so both sides
+// survive simultaneous handshakes and rekeying
+func (ctrl *SessionCtrl)RecvSessions(peer ip.IP4) []*crypt.Session {
+	ctrl.RLock()
+	defer ctrl.RUnlock()
+
+	ps, _ := ctrl.list[peer]
+	if ps == nil || ps.cur == nil || time.Since(ps.created) > REJECT_AFTER {
+		return nil
+	}
+	if ps.prev != nil {
+		return []*crypt.Session{ps.cur, ps.prev}
+	}
+	return []*crypt.Session{ps.cur}
+}
+
+func (ctrl *SessionCtrl)peerSession(peer ip.IP4) *PeerSession {
+	ps, _ := ctrl.list[peer]
+	if ps == nil {
+		ps = new(PeerSession)
+		ctrl.list[peer] = ps
+	}
+	return ps
+}
+
+func (ctrl *SessionCtrl)Establish(peer ip.IP4, s *crypt.Session)  {
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	ps := ctrl.peerSession(peer)
+	ps.prev = ps.cur
+	ps.cur = s
+	ps.created = time.Now()
+
+	logs.Info("session with %s established", peer.String())
+}
+
+func (ctrl *SessionCtrl)StartPending(peer ip.IP4, peerStatic []byte) ([]byte, error) {
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	ps := ctrl.peerSession(peer)
+	if ps.pending != nil && time.Since(ps.pendingAt) < HANDSHAKE_RETRY {
+		return nil, nil
+	}
+
+	hs, msg, err := crypt.NewInitiator(keyPair, peerStatic)
+	if err != nil {
+		return nil, err
+	}
+	ps.pending = hs
+	ps.pendingAt = time.Now()
+	return msg, nil
+}
+
+func (ctrl *SessionCtrl)TakePending(peer ip.IP4) *crypt.Handshake {
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	ps, _ := ctrl.list[peer]
+	if ps == nil {
+		return nil
+	}
+	hs := ps.pending
+	ps.pending = nil
+	return hs
+}
+
+// initiation timestamps must grow, a replayed initiation is dropped
+func (ctrl *SessionCtrl)AcceptInit(peer ip.IP4, timestamp uint64) bool {
+	ctrl.Lock()
+	defer ctrl.Unlock()
+
+	ps := ctrl.peerSession(peer)
+	if timestamp <= ps.lastInit {
+		return false
+	}
+	ps.lastInit = timestamp
+	return true
+}
+
+func buildFrame(typ uint8, peer ip.IP4) ip.FrameHeader {
+	return ip.FrameHeader{Type: typ, TTL: ip.MAX_FRAMETTL, SAddr: selfOverIP, DAddr: peer}
+}
+
+func SealFrame(s *crypt.Session, peer ip.IP4, payload []byte) []byte {
+	hdr := buildFrame(ip.FRAME_SEALED, peer)
+	sealed := s.Seal(hdr.AAD(), payload)
+
+	output := make([]byte, ip.MAX_FRAMEHEADER + len(sealed))
+	hdr.Coder(output)
+	copy(output[ip.MAX_FRAMEHEADER:], sealed)
+	return output
+}
+
+func OpenFrame(body []byte) (*ip.FrameHeader, []byte, error) {
+	hdr := ip.FrameHeaderDecoder(body)
+	if hdr == nil {
+		return nil, nil, fmt.Errorf("sealed frame length %d too small", len(body))
+	}
+
+	if hdr.DAddr != selfOverIP {
+		return nil, nil, fmt.Errorf("sealed frame not for us %s", hdr.String())
+	}
+
+	sessions := sessionCtrl.RecvSessions(hdr.SAddr)
+	if len(sessions) == 0 {
+		return nil, nil, fmt.Errorf("no session with %s", hdr.SAddr.String())
+	}
+
+	var err error
+	var plain []byte
+	for _, s := range sessions {
+		plain, err = s.Open(hdr.AAD(), body[ip.MAX_FRAMEHEADER:])
+		if err == nil {
+			return hdr, plain, nil
+		}
+		if _, ok := err.(*crypt.ReplayError); ok {
+			break
+		}
+	}
+	return nil, nil, err
+}
+
+func handshakeFrame(peer ip.IP4, typ byte, msg []byte) []byte {
+	hdr := buildFrame(ip.FRAME_HANDSHAKE, peer)
+
+	output := make([]byte, ip.MAX_FRAMEHEADER + 1 + len(msg))
+	hdr.Coder(output)
+	output[ip.MAX_FRAMEHEADER] = typ
+	copy(output[ip.MAX_FRAMEHEADER + 1:], msg)
+	return output
+}
+
+func HandshakeInit(conn udp.Transport, dstAddr net.Addr, peer ip.IP4) error {
+	r := routeCtrl.Route(peer)
+	if r == nil || len(r.PubKey) == 0 {
+		return fmt.Errorf("no public key of %s", peer.String())
+	}
+
+	msg, err := sessionCtrl.StartPending(peer, r.PubKey)
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		return nil
+	}
+
+	logs.Info("start handshake with %s via %s", peer.String(), dstAddr.String())
+
+	return conn.WriteTo(handshakeFrame(peer, HANDSHAKE_INIT, msg), dstAddr)
+}
+
+func ProcessHandshake(conn udp.Transport, srcAddr net.Addr, body []byte)  {
+	hdr := ip.FrameHeaderDecoder(body)
+	if hdr == nil || len(body) < ip.MAX_FRAMEHEADER + 1 {
+		logs.Error("handshake frame length %d too small", len(body))
+		return
+	}
+
+	if hdr.DAddr != selfOverIP {
+		logs.Error("drop handshake not for us", hdr.String())
+		return
+	}
+
+	msg := body[ip.MAX_FRAMEHEADER + 1:]
+
+	switch body[ip.MAX_FRAMEHEADER] {
+	case HANDSHAKE_INIT:
+		r := routeCtrl.Route(hdr.SAddr)
+		if r == nil || len(r.PubKey) == 0 {
+			logs.Error("drop handshake from unknown peer", hdr.String())
+			return
+		}
+
+		hs, err := crypt.ConsumeInit(keyPair, msg)
+		if err != nil {
+			logs.Error("handshake init from %s fail, %s", hdr.SAddr.String(), err.Error())
+			return
+		}
+
+		if bytes.Equal(hs.PeerStatic(), r.PubKey) == false {
+			logs.Error("handshake init from %s with unknown static key", hdr.SAddr.String())
+			return
+		}
+
+		if sessionCtrl.AcceptInit(hdr.SAddr, hs.Timestamp()) == false {
+			logs.Warn("drop replayed handshake init", hdr.String())
+			return
+		}
+
+		resp, s, err := hs.Response()
+		if err != nil {
+			logs.Error("handshake response to %s fail, %s", hdr.SAddr.String(), err.Error())
+			return
+		}
+		sessionCtrl.Establish(hdr.SAddr, s)
+
+		err = conn.WriteTo(handshakeFrame(hdr.SAddr, HANDSHAKE_RESP, resp), srcAddr)
+		if err != nil {
+			logs.Error("udp send handshake fail", err.Error())
+		}
+
+	case HANDSHAKE_RESP:
+		hs := sessionCtrl.TakePending(hdr.SAddr)
+		if hs == nil {
+			logs.Warn("drop unexpected handshake response", hdr.String())
+			return
+		}
+
+		s, err := hs.ConsumeResponse(msg)
+		if err != nil {
+			logs.Error("handshake response from %s fail, %s", hdr.SAddr.String(), err.Error())
+			return
+		}
+		sessionCtrl.Establish(hdr.SAddr, s)
+
+	default:
+		logs.Error("drop unknown handshake message", hdr.String())
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/util/stream"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const STREAM_DIAL_TIMEOUT = 10 * time.Second
+
+func dialStream(addr string, useTLS bool) (net.Conn, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	bypassTransfer(tcpAddr.IP)
+
+	conn, err := net.DialTimeout("tcp", tcpAddr.String(), STREAM_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	if useTLS == false {
+		return conn, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the transfer certificate is usually self signed; tls is only there
+	// to get through firewalls, control messages are authenticated by
+	// the token and data is sealed end to end
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	tlsConn.SetDeadline(time.Now().Add(STREAM_DIAL_TIMEOUT))
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s fail, %s", addr, err.Error())
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// the stream becomes the transfer address and all traffic to peers goes
+// by the transfer
+func attachStream(t *TransferCtrl, fc stream.FrameConn, desc string) error {
+	_, portStr, err := net.SplitHostPort(t.name)
+	if err != nil {
+		fc.Close()
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		fc.Close()
+		return err
+	}
+
+	err = stream.WriteHello(fc, port)
+	if err != nil {
+		fc.Close()
+		return err
+	}
+
+	conn := udpHander.Attach(fc)
+	t.setStream(conn)
+	bypassTransfer(t.UnderlayIP())
+
+	logs.Info("%s to transfer attached as %s", desc, conn.Addr().String())
+
+	// before the tun is up the requests waiting for an answer read the
+	// stream themselves
+	if tunHandler != nil {
+		go UdpRecvTask(conn, tunHandler)
+	}
+
+	go func() {
+		<-conn.Done()
+		t.StreamLost(conn)
+	}()
+	return nil
+}
+
+// fall back to a tcp or tls stream toward the transfer when udp does not
+// get through
+func initStream(t *TransferCtrl, addr string, useTLS bool) error {
+	conn, err := dialStream(addr, useTLS)
+	if err != nil {
+		return err
+	}
+	return attachStream(t, stream.NewStreamConn(conn), "stream " + addr)
+}
+
+// the last resort, a websocket through the http proxy; without -proxy
+// the proxy comes from the HTTPS_PROXY and HTTP_PROXY environment
+func initWebSocket(t *TransferCtrl, rawurl string, proxy string) error {
+	proxyURL, err := webSocketProxy(rawurl, proxy)
+	if err != nil {
+		return err
+	}
+	if proxyURL != nil {
+		logs.Info("websocket %s through proxy %s", rawurl, proxyURL.Host)
+	}
+
+	fc, err := stream.DialWebSocket(rawurl, proxyURL)
+	if err != nil {
+		return err
+	}
+	return attachStream(t, fc, "websocket " + rawurl)
+}
+
+func webSocketProxy(rawurl string, proxy string) (*url.URL, error) {
+	if proxy != "" {
+		return url.Parse(proxy)
+	}
+
+	target, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	// the environment lookup only knows http schemes
+	req := &http.Request{URL: &url.URL{Scheme: "https", Host: target.Host}}
+	if target.Scheme == "ws" {
+		req.URL.Scheme = "http"
+	}
+	return http.ProxyFromEnvironment(req)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/util/ip"
+	"strings"
+	"sync"
+)
+
+// the lan subnets behind this gateway, the default route of an exit
+// node is not among them, it would take in every address
+var localSubnets []ip.IP4Net
+
+func initSubnets(subnets string, exit bool) error {
+	for _, v := range strings.Split(subnets, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		ipn, err := ip.ParseIP4Net(v)
+		if err != nil {
+			return fmt.Errorf("subnet %s is invalid, %s", v, err.Error())
+		}
+		localSubnets = append(localSubnets, ipn.Network())
+	}
+
+	if len(localSubnets) > 0 {
+		logs.Info("advertise subnets %v", localSubnets)
+	}
+	if exit {
+		logs.Info("advertise default route %s", defaultNet.String())
+	}
+	return nil
+}
+
+// the subnets published with the local route
+func advertiseSubnets() []ip.IP4Net {
+	if EXIT_NODE == false {
+		return localSubnets
+	}
+	subnets := make([]ip.IP4Net, 0, len(localSubnets) + 1)
+	subnets = append(subnets, localSubnets...)
+	return append(subnets, defaultNet)
+}
+
+func localSubnet(ip4 ip.IP4) bool {
+	for _, v := range localSubnets {
+		if v.Contains(ip4) {
+			return true
+		}
+	}
+	return false
+}
+
+// a peer may only send from its own address or the subnets it
+// advertises, and only toward this gateway or the subnets behind it,
+// anywhere when this is an exit node
+func CheckSubnet(frameHdr *ip.FrameHeader, ip4hdr *ip.IP4Header) error {
+	if ip4hdr.DAddr != selfOverIP && localSubnet(ip4hdr.DAddr) == false && EXIT_NODE == false {
+		return fmt.Errorf("destination %s is not behind us", ip4hdr.DAddr.String())
+	}
+
+	e := routeCtrl.Lookup(ip4hdr.SAddr)
+	if e == nil || e.Route.IP != frameHdr.SAddr {
+		return fmt.Errorf("source %s is not owned by %s", ip4hdr.SAddr.String(), frameHdr.SAddr.String())
+	}
+	return nil
+}
+
+var overlayNet ip.IP4Net
+
+type SubnetCtrl struct {
+	sync.Mutex
+	installed map[ip.IP4Net]bool
+}
+
+var subnetCtrl = &SubnetCtrl{installed: make(map[ip.IP4Net]bool, 64)}
+
+// keep the routes on the tun in line with the subnets peers advertise
+func SyncSubnets()  {
+	if tunHandler == nil {
+		return
+	}
+
+	subnetCtrl.Lock()
+	defer subnetCtrl.Unlock()
+
+	wanted := make(map[ip.IP4Net]bool, 64)
+	for _, r := range routeCtrl.Export() {
+		if r.IP == selfOverIP {
+			continue
+		}
+		for _, v := range r.Subnets {
+			v = v.Network()
+			if v.PrefixLen == 0 || localSubnet(v.IP) || overlayNet.Network().Equal(v) {
+				continue
+			}
+			wanted[v] = true
+		}
+	}
+
+	for v, _ := range wanted {
+		if subnetCtrl.installed[v] {
+			continue
+		}
+		err := tunHandler.AddRoute(v)
+		if err != nil {
+			logs.Error("install subnet route fail", err.Error())
+			continue
+		}
+		subnetCtrl.installed[v] = true
+		logs.Info("install subnet route %s", v.String())
+	}
+
+	for v, _ := range subnetCtrl.installed {
+		if wanted[v] {
+			continue
+		}
+		err := tunHandler.DelRoute(v)
+		if err != nil {
+			logs.Error("remove subnet route fail", err.Error())
+			continue
+		}
+		delete(subnetCtrl.installed, v)
+		logs.Info("remove subnet route %s", v.String())
+	}
+}
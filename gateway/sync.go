@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/route"
+	"github.com/easymesh/easymesh/util/ip"
+	"github.com/easymesh/easymesh/util/udp"
+	"time"
+)
+
+// a full table now and then puts right whatever went astray
+const TRANS_FULL_SYNC_TIME = 10 * time.Minute
+
+// the chunks of one route sync, gathered until all of them are in
+type syncParts struct {
+	epoch     uint64
+	from      uint64
+	version   uint64
+	got       map[int]bool
+	routes    []ip.IP4
+	withdrawn []ip.IP4
+	relays    []route.Relay
+}
+
+// the table version held from the transfer, zero asks for the full one
+func (t *TransferCtrl)syncFrom() (uint64, uint64) {
+	t.RLock()
+	defer t.RUnlock()
+
+	if time.Since(t.fullAt) > TRANS_FULL_SYNC_TIME {
+		return t.epoch, 0
+	}
+	return t.epoch, t.known
+}
+
+// whether the transfer announces the route
+func (t *TransferCtrl)Announces(ip4 ip.IP4) bool {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.routes[ip4]
+}
+
+// take a chunk in; a delta not starting from the version held is late
+// and dropped, the sync is returned once all its chunks are in
+func (t *TransferCtrl)gather(s *route.RouteSync) (bool, *syncParts) {
+	t.Lock()
+	defer t.Unlock()
+
+	if s.Full() == false && (s.Epoch != t.epoch || s.From != t.known) {
+		return false, nil
+	}
+
+	p := t.parts
+	if p == nil || p.epoch != s.Epoch || p.from != s.From || p.version != s.Version {
+		p = &syncParts{epoch: s.Epoch, from: s.From, version: s.Version, got: make(map[int]bool, s.Chunks)}
+		t.parts = p
+	}
+	if p.got[s.Chunk] {
+		return false, nil
+	}
+	p.got[s.Chunk] = true
+
+	for _, v := range s.Routes {
+		p.routes = append(p.routes, v.IP)
+	}
+	p.withdrawn = append(p.withdrawn, s.Withdrawn...)
+	p.relays = append(p.relays, s.Relays...)
+
+	if len(p.got) < s.Chunks {
+		return true, nil
+	}
+	t.parts = nil
+	return true, p
+}
+
+// a complete sync moves the transfer to its version, returns the routes
+// it announces now and those it gave up
+func (t *TransferCtrl)commit(p *syncParts) ([]ip.IP4, []ip.IP4) {
+	t.Lock()
+	defer t.Unlock()
+
+	gone := make([]ip.IP4, 0)
+	if p.from == 0 {
+		next := make(map[ip.IP4]bool, len(p.routes))
+		for _, v := range p.routes {
+			next[v] = true
+		}
+		for k, _ := range t.routes {
+			if next[k] == false {
+				gone = append(gone, k)
+			}
+		}
+		t.routes = next
+		t.fullAt = time.Now()
+	} else {
+		for _, v := range p.routes {
+			t.routes[v] = true
+		}
+		for _, v := range p.withdrawn {
+			if t.routes[v] {
+				delete(t.routes, v)
+				gone = append(gone, v)
+			}
+		}
+	}
+	t.epoch = p.epoch
+	t.known = p.version
+
+	announced := make([]ip.IP4, 0, len(t.routes))
+	for k, _ := range t.routes {
+		announced = append(announced, k)
+	}
+	return announced, gone
+}
+
+// start over with the full table, the transfer went away and may come
+// back as another instance; called with the lock held
+func (t *TransferCtrl)syncReset()  {
+	t.known = 0
+	t.parts = nil
+}
+
+func announcedElsewhere(t *TransferCtrl, ip4 ip.IP4) bool {
+	for _, v := range transfers {
+		if v != t && v.Announces(ip4) {
+			return true
+		}
+	}
+	return false
+}
+
+func SyncRoute(t *TransferCtrl, msg *udp.Msg) error {
+	body, err := CtrlDecoder(t.name, msg)
+	if err != nil {
+		return fmt.Errorf("sync route from transfer fail, %s", err.Error())
+	}
+
+	var s *route.RouteSync
+	if msg.Legacy() {
+		// the deprecated answer is the full table in a single list
+		routelist := route.RouteListDecoder(body)
+		if len(routelist) == 0 {
+			return fmt.Errorf("sync route from transfer fail")
+		}
+		s = &route.RouteSync{Chunks: 1, Routes: routelist, Relays: routelist.Relays()}
+	} else {
+		s = route.RouteSyncDecoder(body)
+		if s == nil || s.Chunk < 0 || s.Chunk >= s.Chunks {
+			return fmt.Errorf("sync route from transfer fail")
+		}
+	}
+	t.Recv(msg.Version)
+	selectTransfer()
+
+	accept, p := t.gather(s)
+	if accept == false {
+		logs.Debug("drop late route sync from transfer %s, version %d -> %d", t.name, s.From, s.Version)
+		return nil
+	}
+	routeCtrl.SyncBatch(s.Routes)
+	logs.Info("sync route from transfer", s.Chunk, s.Chunks, s.Routes.String())
+
+	if p == nil {
+		return nil
+	}
+
+	announced, gone := t.commit(p)
+	for _, v := range gone {
+		if announcedElsewhere(t, v) {
+			continue
+		}
+		logs.Info("route %s withdrawn by transfer %s", v.String(), t.name)
+		routeCtrl.Withdraw(v)
+	}
+	routeCtrl.SetRelays(announced, p.relays)
+	routeCtrl.Refresh(announced)
+
+	logs.Debug("transfer %s table version %d -> %d, %d routes", t.name, p.from, p.version, len(announced))
+	return nil
+}
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/route"
+	"github.com/easymesh/easymesh/util/crypt"
+	"github.com/easymesh/easymesh/util/ip"
+	"github.com/easymesh/easymesh/util/stream"
+	"github.com/easymesh/easymesh/util/udp"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TRANS_STATE int
+
+const (
+	TRANS_CONNECTING TRANS_STATE = iota
+	TRANS_REGISTERED
+	TRANS_DEGRADED
+	TRANS_LOST
+)
+
+func (s TRANS_STATE)String() string {
+	switch s {
+	case TRANS_CONNECTING:return "connecting"
+	case TRANS_REGISTERED:return "registered"
+	case TRANS_DEGRADED:return "degraded"
+	default:
+		return "lost"
+	}
+}
+
+const (
+	TRANS_UPDATE_TIME   = 15 * time.Second
+	TRANS_ANSWER_TIME   = 5 * time.Second
+	TRANS_DEGRADED_TIME = 35 * time.Second
+	TRANS_LOST_TIME     = 60 * time.Second
+	TRANS_BACKOFF_MIN   = 5 * time.Second
+	TRANS_BACKOFF_MAX   = 2 * time.Minute
+)
+
+// the connection to one transfer; route updates going unanswered first
+// make it degraded and then lost, a lost transfer is resolved and
+// connected again with exponential backoff while peers keep talking
+// over the direct paths they already have
+type TransferCtrl struct {
+	sync.RWMutex
+	name     string
+	primary  bool
+	state    TRANS_STATE
+	addr     *net.UDPAddr
+	addr6    *net.UDPAddr
+	stream   *stream.Transport
+	lastRecv time.Time
+	backoff  time.Duration
+	rtt      TransRTT
+	proto    byte
+	pubKey   []byte
+
+	// the route table held from the transfer, see sync.go
+	epoch    uint64
+	known    uint64
+	fullAt   time.Time
+	routes   map[ip.IP4]bool
+	parts    *syncParts
+
+	answer chan struct{}
+	wake   chan struct{}
+}
+
+func NewTransferCtrl(name string, primary bool) *TransferCtrl {
+	return &TransferCtrl{name: name, primary: primary, proto: udp.MSG_VERSION, routes: make(map[ip.IP4]bool, 64),
+		answer: make(chan struct{}, 1), wake: make(chan struct{}, 1)}
+}
+
+func (t *TransferCtrl)State() TRANS_STATE {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.state
+}
+
+// where ctrl messages and relayed frames for the transfer go, its udp
+// address or the stream it is reached by
+func (t *TransferCtrl)Addr() net.Addr {
+	t.RLock()
+	defer t.RUnlock()
+
+	if t.stream != nil {
+		return t.stream.Addr()
+	}
+	if t.addr == nil {
+		return nil
+	}
+	return t.addr
+}
+
+// nil while the transfer is reached by a stream
+func (t *TransferCtrl)UdpAddr() *net.UDPAddr {
+	t.RLock()
+	defer t.RUnlock()
+
+	if t.stream != nil {
+		return nil
+	}
+	return t.addr
+}
+
+func (t *TransferCtrl)Addr6() *net.UDPAddr {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.addr6
+}
+
+// the ctrl message version the transfer answers in
+func (t *TransferCtrl)Proto() byte {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.proto
+}
+
+// the static key of the transfer, registers and leaves prove ours
+// toward it; nil until the transfer tells it
+func (t *TransferCtrl)PubKey() []byte {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.pubKey
+}
+
+// returns whether the key is new, the transfer may have been set up
+// again with another one; with -transkey only the keys given there are
+// taken, else the key is trusted on first use and every change is
+// warned of
+func (t *TransferCtrl)pubKeySet(pubKey []byte) bool {
+	if len(pubKey) != crypt.PUBKEY_SIZE {
+		return false
+	}
+	if transKeyPinned(pubKey) == false {
+		logs.Error("transfer %s key %s is not one of -transkey", t.name, base64.StdEncoding.EncodeToString(pubKey))
+		return false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if bytes.Equal(t.pubKey, pubKey) {
+		return false
+	}
+	if t.pubKey != nil {
+		logs.Warn("transfer %s key changed from %s to %s", t.name,
+			base64.StdEncoding.EncodeToString(t.pubKey), base64.StdEncoding.EncodeToString(pubKey))
+	} else {
+		logs.Info("transfer %s key %s", t.name, base64.StdEncoding.EncodeToString(pubKey))
+	}
+	t.pubKey = pubKey
+	return true
+}
+
+// proof of our key toward the transfer, bound to the sequence number of
+// the message; none while the transfer key is unknown
+func (t *TransferCtrl)proof(label string, seq uint64, claim []byte) []byte {
+	pubKey := t.PubKey()
+	if pubKey == nil {
+		return nil
+	}
+	proof, err := keyPair.Proof(pubKey, label, seq, claim)
+	if err != nil {
+		logs.Error("key proof toward transfer %s fail, %s", t.name, err.Error())
+		return nil
+	}
+	return proof
+}
+
+func (t *TransferCtrl)registerCoder(proto byte, reg *route.Register) []byte {
+	seq := crypt.NextSequence()
+	reg.Proof = t.proof(route.PROOF_REGISTER, seq, reg.Claim())
+	return CtrlSeqCoder(proto, udp.MSG_REGISTER, seq, reg.Coder())
+}
+
+func (t *TransferCtrl)Stream() *stream.Transport {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.stream
+}
+
+// where the transfer really is, the far end of the stream in stream
+// mode
+func (t *TransferCtrl)UnderlayIP() net.IP {
+	t.RLock()
+	defer t.RUnlock()
+
+	if t.stream != nil {
+		addr, ok := t.stream.Addr().Remote().(*net.TCPAddr)
+		if ok {
+			return addr.IP
+		}
+	}
+	if t.addr == nil {
+		return nil
+	}
+	return t.addr.IP
+}
+
+// the transfer sent this, over udp, over its ipv6 address or over the
+// stream
+func (t *TransferCtrl)Match(srcAddr net.Addr) bool {
+	t.RLock()
+	defer t.RUnlock()
+
+	if t.stream != nil {
+		return srcAddr.String() == t.stream.Addr().String()
+	}
+	if t.addr != nil && srcAddr.String() == t.addr.String() {
+		return true
+	}
+	return t.addr6 != nil && srcAddr.String() == t.addr6.String()
+}
+
+// switch to a new transfer address, a stream left over from an earlier
+// connection is closed
+func (t *TransferCtrl)setAddr(addr *net.UDPAddr)  {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.stream != nil {
+		t.stream.Close()
+		t.stream = nil
+	}
+	t.addr = addr
+	t.addr6 = nil
+}
+
+func (t *TransferCtrl)setStream(conn *stream.Transport)  {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.stream != nil && t.stream != conn {
+		t.stream.Close()
+	}
+	t.stream = conn
+	t.addr6 = nil
+}
+
+func (t *TransferCtrl)setAddr6(addr6 *net.UDPAddr)  {
+	t.Lock()
+	defer t.Unlock()
+
+	t.addr6 = addr6
+}
+
+// an answer of the transfer came in the version given
+func (t *TransferCtrl)protoSet(proto byte)  {
+	if t.proto != proto {
+		logs.Warn("transfer %s speaks ctrl version %d", t.name, proto)
+		t.proto = proto
+	}
+}
+
+// called with the lock held
+func (t *TransferCtrl)registered()  {
+	if t.state != TRANS_REGISTERED {
+		logs.Info("transfer %s %s -> %s", t.name, t.state.String(), TRANS_REGISTERED.String())
+		t.state = TRANS_REGISTERED
+		t.backoff = 0
+	}
+}
+
+// a route sync from the transfer came in, in the version given; only a
+// degraded transfer is back by that, a new connection is finished by
+// connect, route syncs left over from the address claim come in early
+func (t *TransferCtrl)Recv(proto byte)  {
+	t.Lock()
+	defer t.Unlock()
+
+	t.protoSet(proto)
+	t.rtt.Recv()
+	t.lastRecv = time.Now()
+	if t.state == TRANS_DEGRADED {
+		t.registered()
+	}
+
+	select {
+	case t.answer <- struct{}{}:
+	default:
+	}
+}
+
+func (t *TransferCtrl)stateSet(state TRANS_STATE)  {
+	if t.state == state {
+		return
+	}
+	logs.Warn("transfer %s %s -> %s", t.name, t.state.String(), state.String())
+	t.state = state
+
+	// it may come back upgraded or as another instance, the current
+	// version and the full table are asked for again
+	if state == TRANS_LOST {
+		t.proto = udp.MSG_VERSION
+		t.syncReset()
+	}
+}
+
+// age the connection by the time since the last answer
+func (t *TransferCtrl)Check()  {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.state != TRANS_REGISTERED && t.state != TRANS_DEGRADED {
+		return
+	}
+
+	idle := time.Since(t.lastRecv)
+	if idle > TRANS_LOST_TIME {
+		t.stateSet(TRANS_LOST)
+	} else if idle > TRANS_DEGRADED_TIME {
+		t.stateSet(TRANS_DEGRADED)
+	}
+}
+
+// the stream to the transfer broke, no need to wait for route updates
+// to time out
+func (t *TransferCtrl)StreamLost(conn *stream.Transport)  {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.stream != conn {
+		return
+	}
+	logs.Error("transfer %s lost %s", t.name, conn.Addr().String())
+	t.stateSet(TRANS_LOST)
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (t *TransferCtrl)nextBackoff() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.backoff == 0 {
+		t.backoff = TRANS_BACKOFF_MIN
+	} else {
+		t.backoff *= 2
+		if t.backoff > TRANS_BACKOFF_MAX {
+			t.backoff = TRANS_BACKOFF_MAX
+		}
+	}
+	return t.backoff
+}
+
+// send the local route and wait for the transfer to answer with the
+// route list
+func (t *TransferCtrl)register() error {
+	select {
+	case <-t.answer:
+	default:
+	}
+
+	for i := 0; i < 3; i++ {
+		UpdateRoute(t, t.tryProto(i))
+
+		select {
+		case <-t.answer:
+			return nil
+		case <-time.After(TRANS_ANSWER_TIME):
+		}
+	}
+	return fmt.Errorf("transfer %s no answer", t.name)
+}
+
+// a transfer not upgraded yet drops versioned messages, the last one of
+// the tries goes in the deprecated format; it knows of no networks
+func (t *TransferCtrl)tryProto(try int) byte {
+	if try == 2 && NETWORK == "" {
+		return 0
+	}
+	return t.Proto()
+}
+
+// a request answered before the udp receive tasks run, the answers are
+// read right here; answer tells whether it got what it waits for
+func (t *TransferCtrl)request(conn udp.Transport, req func(proto byte) []byte, answer func(msg *udp.Msg) (bool, error)) error {
+	var buff [8192]byte
+
+	// the answers over a stream come in on the stream
+	if s := t.Stream(); s != nil {
+		conn = s
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	for i := 0; i < 3; i++ {
+		err := conn.WriteTo(req(t.tryProto(i)), t.Addr())
+		if err != nil {
+			return err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(TRANS_ANSWER_TIME))
+		for  {
+			cnt, srcAddr, err := conn.ReadFrom(buff[:])
+			if err != nil {
+				break
+			}
+			if cnt < 1 || t.Match(srcAddr) == false {
+				continue
+			}
+			typ := ip.IPHeaderType(buff[0])
+			if typ != ip.IPMsg && typ != ip.IPCtrl {
+				continue
+			}
+			msg, err := udp.CtrlMsgDecoder(buff[:cnt], udp.MSG_ROUTE_UPDATE)
+			if err != nil {
+				logs.Warn("drop ctrl from %s, %s", srcAddr.String(), err.Error())
+				continue
+			}
+
+			done, err := answer(msg)
+			if err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("transfer %s no answer", t.name)
+}
+
+// resolve the transfer again, it may have moved, and run the exchange
+// over udp first; the tcp stream and the websocket lead to the primary
+// transfer only
+func (t *TransferCtrl)reach(exchange func() error) error {
+	addr, err := net.ResolveUDPAddr("udp", t.name)
+	if err == nil {
+		logs.Info("%s reslove to %s", t.name, addr.String())
+		t.setAddr(addr)
+		bypassTransfer(addr.IP)
+		err = exchange()
+	}
+	if _, refused := err.(*route.Error); refused {
+		return err
+	}
+	if err != nil && t.primary && TRANS_TCP != "" {
+		logs.Warn("udp to transfer fail, fall back to stream %s, %s", TRANS_TCP, err.Error())
+
+		err = initStream(t, TRANS_TCP, TRANS_TLS)
+		if err == nil {
+			err = exchange()
+		}
+	}
+	if err != nil && t.primary && TRANS_WS != "" {
+		logs.Warn("fall back to websocket %s, %s", TRANS_WS, err.Error())
+
+		err = initWebSocket(t, TRANS_WS, HTTP_PROXY)
+		if err == nil {
+			err = exchange()
+		}
+	}
+	return err
+}
+
+func (t *TransferCtrl)connect() error {
+	err := t.reach(t.register)
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	t.lastRecv = time.Now()
+	t.registered()
+	t.Unlock()
+
+	logs.Info("transfer connect %s suucess", t.Addr().String())
+
+	addr := t.UdpAddr()
+	if addr == nil {
+		return nil
+	}
+
+	// route updates also go over ipv6, so the transfer learns the ipv6
+	// address peers can reach us by
+	if len(localUdpAddrs6) > 0 && addr.IP.To4() != nil {
+		addr6, err := net.ResolveUDPAddr("udp6", t.name)
+		if err != nil {
+			logs.Info("%s has no ipv6 address, %s", t.name, err.Error())
+		} else {
+			t.setAddr6(addr6)
+			logs.Info("%s reslove to %s", t.name, addr6.String())
+		}
+	}
+
+	selectTransfer()
+	if t == currentTransfer() {
+		go InitNat(udpHander, t)
+	}
+	return nil
+}
+
+func (t *TransferCtrl)Task()  {
+	ticker := time.NewTicker(TRANS_UPDATE_TIME)
+	defer ticker.Stop()
+
+	for  {
+		state := t.State()
+		if state == TRANS_CONNECTING || state == TRANS_LOST {
+			err := t.connect()
+			selectTransfer()
+			if err != nil {
+				wait := t.nextBackoff()
+				logs.Error("transfer connect fail, retry in %s, %s", wait.String(), err.Error())
+				time.Sleep(wait)
+			}
+			continue
+		}
+
+		select {
+		case <-ticker.C:
+		case <-t.wake:
+			selectTransfer()
+			continue
+		}
+
+		t.Check()
+		selectTransfer()
+		if t.State() != TRANS_LOST {
+			UpdateRoute(t, t.Proto())
+		}
+	}
+}
+
+// every gateway registers with all transfers in -trans and merges
+// their route lists; relaying and punch requests go by the current one
+var transfers []*TransferCtrl
+
+var transferSel struct {
+	sync.RWMutex
+	current *TransferCtrl
+}
+
+func initTransfers(list string) error {
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		_, _, err := net.SplitHostPort(v)
+		if err != nil {
+			return fmt.Errorf("transfer %s is invalid, %s", v, err.Error())
+		}
+		transfers = append(transfers, NewTransferCtrl(v, len(transfers) == 0))
+	}
+	if len(transfers) == 0 {
+		return fmt.Errorf("transfer address is empty")
+	}
+	return nil
+}
+
+// the transfer keys pinned by -transkey, none trusts the key a transfer
+// tells first
+var transKeys [][]byte
+
+func initTransKeys(list string) error {
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(key) != crypt.PUBKEY_SIZE {
+			return fmt.Errorf("transfer key %s is invalid", v)
+		}
+		transKeys = append(transKeys, key)
+	}
+
+	// a single key is the one of every transfer, registers are proven
+	// from the first one on
+	if len(transKeys) == 1 {
+		for _, t := range transfers {
+			t.pubKey = transKeys[0]
+		}
+	}
+	if len(transKeys) > 0 {
+		logs.Info("transfer keys pinned %d", len(transKeys))
+	}
+	return nil
+}
+
+func transKeyPinned(pubKey []byte) bool {
+	if len(transKeys) == 0 {
+		return true
+	}
+	for _, v := range transKeys {
+		if bytes.Equal(v, pubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func startTransfers()  {
+	for _, t := range transfers {
+		go t.Task()
+	}
+}
+
+// tell the transfers the address is given up so peers withdraw the route
+// at once; transfers speaking the deprecated format know nothing of it
+func leaveTransfers(conn udp.Transport)  {
+	for _, t := range transfers {
+		proto := t.Proto()
+		if proto == 0 {
+			continue
+		}
+		addr := t.Addr()
+		if addr == nil {
+			a6 := t.Addr6()
+			if a6 == nil {
+				continue
+			}
+			addr = a6
+		}
+
+		logs.Info("leave transfer %s", t.name)
+
+		seq := crypt.NextSequence()
+		leave := &route.Leave{IP: selfOverIP, PubKey: keyPair.PublicKey()}
+		leave.Proof = t.proof(route.PROOF_LEAVE, seq, leave.Claim())
+
+		err := conn.WriteTo(CtrlSeqCoder(proto, udp.MSG_LEAVE, seq, leave.Coder()), addr)
+		if err != nil {
+			logs.Error("leave transfer %s fail, %s", t.name, err.Error())
+		}
+	}
+}
+
+// the transfer that sent a ctrl message, nil when it is none of ours
+func fromTransfer(srcAddr net.Addr) *TransferCtrl {
+	for _, t := range transfers {
+		if t.Match(srcAddr) {
+			return t
+		}
+	}
+	return nil
+}
+
+func currentTransfer() *TransferCtrl {
+	transferSel.RLock()
+	defer transferSel.RUnlock()
+
+	return transferSel.current
+}
+
+func currentTransAddr() net.Addr {
+	t := currentTransfer()
+	if t == nil {
+		return nil
+	}
+	return t.Addr()
+}
+
+// the first transfer in -trans order that answers is the current one,
+// failing that the first one just degraded; routes are held while no
+// transfer refreshes them
+func selectTransfer()  {
+	var current *TransferCtrl
+	registered := false
+	for _, t := range transfers {
+		state := t.State()
+		if state == TRANS_REGISTERED {
+			current = t
+			registered = true
+			break
+		}
+		if state == TRANS_DEGRADED && current == nil {
+			current = t
+		}
+	}
+	routeCtrl.Hold(registered == false)
+
+	transferSel.Lock()
+	defer transferSel.Unlock()
+
+	if transferSel.current == current {
+		return
+	}
+	if current != nil {
+		logs.Info("relay by transfer %s", current.name)
+	} else {
+		logs.Warn("no transfer to relay by")
+	}
+	transferSel.current = current
+}
+
+// the current transfer is reached over a stream, peers are only
+// reached by relay then
+func streamMode() bool {
+	t := currentTransfer()
+	return t != nil && t.Stream() != nil
+}
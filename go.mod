@@ -1,11 +1,14 @@
 module github.com/easymesh/easymesh
 
-go 1.14
+go 1.20
 
 require (
 	github.com/astaxie/beego v1.12.2
-	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
-	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/vishvananda/netlink v1.1.0
 	golang.org/x/sys v0.0.0-20200615200032-f1bc736245b1
 )
+
+require (
+	github.com/shiena/ansicolor v0.0.0-20151119151921-a422bbe96644 // indirect
+	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df // indirect
+)
@@ -0,0 +1,97 @@
+package route
+
+import (
+	"github.com/easymesh/easymesh/util/ip"
+	"sort"
+	"time"
+)
+
+// direct path a gateway measured toward a peer
+type Link struct {
+	IP  ip.IP4
+	RTT time.Duration
+}
+
+// the register carrying the links has to fit a datagram
+const LINKS_MAX = 64
+
+// direct paths the gateway currently uses, reported to the transfer so
+// it can compute relay paths; only the fastest ones are reported, the
+// slow ones make poor relays anyway
+func (routes *RouteCtrl)Links() []Link {
+	routes.RLock()
+	defer routes.RUnlock()
+
+	links := make([]Link, 0)
+	for _, v := range routes.list {
+		path := v.PathUdpAddr()
+		if path != nil {
+			links = append(links, Link{IP: v.IP, RTT: path.RTT()})
+		}
+	}
+	if len(links) > LINKS_MAX {
+		sort.Slice(links, func(i, j int) bool {
+			return links[i].RTT < links[j].RTT
+		})
+		links = links[:LINKS_MAX]
+	}
+	return links
+}
+
+func (r *Route)linkRTT(peer ip.IP4) (time.Duration, bool) {
+	for _, v := range r.Peers {
+		if v.IP == peer {
+			return v.RTT, true
+		}
+	}
+	return 0, false
+}
+
+// fill Via of every route the source has no direct path to, with the
+// gateway having direct paths to both ends, when going through it is
+// faster than both legs to the transfer
+func (list RouteList)RelayFor(src ip.IP4) RouteList {
+	var self *Route
+	for i, _ := range list {
+		if list[i].IP == src {
+			self = &list[i]
+		}
+	}
+
+	output := make(RouteList, len(list))
+	copy(output, list)
+
+	for i, _ := range output {
+		dst := &output[i]
+		dst.Via = ip.IP4(0)
+
+		if self == nil || dst.IP == src {
+			continue
+		}
+		if _, direct := self.linkRTT(dst.IP); direct {
+			continue
+		}
+
+		best := time.Duration(0)
+		if self.TransRTT > 0 && dst.TransRTT > 0 {
+			best = self.TransRTT + dst.TransRTT
+		}
+
+		for j, _ := range list {
+			via := &list[j]
+			if via.IP == src || via.IP == dst.IP {
+				continue
+			}
+			first, ok1 := self.linkRTT(via.IP)
+			second, ok2 := via.linkRTT(dst.IP)
+			if ok1 == false || ok2 == false {
+				continue
+			}
+			if best == 0 || first + second < best {
+				best = first + second
+				dst.Via = via.IP
+			}
+		}
+	}
+	return output
+}
@@ -1,6 +1,7 @@
 package route
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"github.com/astaxie/beego/logs"
 	"github.com/easymesh/easymesh/util/ip"
@@ -16,28 +17,143 @@ const (
 	UDP_TRANSFER_T
 	UDP_THROUGH_T
 	UDP_LOCALADD_T
+	UDP_PUNCH_T
 )
 
+type NAT_TYPE int
+
+const (
+	NAT_UNKNOWN NAT_TYPE = iota
+	NAT_NONE
+	NAT_FULL_CONE
+	NAT_RESTRICTED
+	NAT_PORT_RESTRICTED
+	NAT_SYMMETRIC
+)
+
+func (n NAT_TYPE)String() string {
+	switch n {
+	case NAT_NONE:return "none"
+	case NAT_FULL_CONE:return "full cone"
+	case NAT_RESTRICTED:return "restricted"
+	case NAT_PORT_RESTRICTED:return "port restricted"
+	case NAT_SYMMETRIC:return "symmetric"
+	default:
+		return "unknown"
+	}
+}
+
+// hole punching can not succeed when one side is symmetric and the
+// other one filters by port as well; a full cone lets every sender in,
+// the other side reaches it whatever its own nat
+func PunchWorth(a NAT_TYPE, b NAT_TYPE) bool {
+	if a == NAT_FULL_CONE || b == NAT_FULL_CONE {
+		return true
+	}
+	if a == NAT_SYMMETRIC && (b == NAT_SYMMETRIC || b == NAT_PORT_RESTRICTED) {
+		return false
+	}
+	if b == NAT_SYMMETRIC && a == NAT_PORT_RESTRICTED {
+		return false
+	}
+	return true
+}
+
 type UdpAddr struct {
 	Typ  UDP_TYPE
 	Udp  net.UDPAddr
 
+	// a gateway reaching the transfer by a stream is reached back by the
+	// stream, the address never leaves the transfer
+	Stream net.Addr `json:"-"`
+
 	used int
 	timestamp time.Time
+	stat pathStat
+}
+
+const (
+	SCORE_MAX    = time.Duration(1 << 62)
+	LOSS_PENALTY = time.Second
+)
+
+// smoothed round trip time, jitter and loss of a path as RFC 6298 does
+// for tcp retransmission timers
+type pathStat struct {
+	srtt    time.Duration
+	jitter  time.Duration
+	loss    float64
+	waiting bool
+}
+
+func (s *pathStat)sample(rtt time.Duration)  {
+	s.waiting = false
+	s.loss = s.loss * 7 / 8
+	if s.srtt == 0 {
+		s.srtt = rtt
+		s.jitter = rtt / 2
+		return
+	}
+	delta := s.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	s.jitter = (3 * s.jitter + delta) / 4
+	s.srtt = (7 * s.srtt + rtt) / 8
+}
+
+// a probe still waiting for its answer when the next one goes out is
+// counted as lost
+func (s *pathStat)probe()  {
+	if s.waiting {
+		s.loss = s.loss * 7 / 8 + 1.0 / 8
+	}
+	s.waiting = true
 }
 
 type Route struct {
-	Token string
-	IP    ip.IP4
-	Udp   []UdpAddr
+	IP     ip.IP4
+	IP6    ip.IP6 `json:",omitempty"`
+	PubKey []byte
+	Nat    NAT_TYPE
+	Udp    []UdpAddr
+
+	Subnets []ip.IP4Net
+
+	Peers    []Link
+	TransRTT time.Duration
+	Via      ip.IP4
+
+	// ctrl message version the owner speaks, zero for the deprecated
+	// format
+	Proto byte `json:",omitempty"`
 
 	timestamp time.Time
+	path      string
+	version   uint64
+	sum       uint64
 }
 
 func NewUdpAddr(typ UDP_TYPE, addr net.UDPAddr) UdpAddr {
 	return UdpAddr{Typ: typ, Udp: addr, timestamp: time.Now()}
 }
 
+// the address a datagram came from, by udp or by a stream
+func NewAddr(typ UDP_TYPE, addr net.Addr) UdpAddr {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if ok {
+		return NewUdpAddr(typ, *udpAddr)
+	}
+	return UdpAddr{Typ: typ, Stream: addr, timestamp: time.Now()}
+}
+
+func (u *UdpAddr)Addr() net.Addr {
+	if u.Stream != nil {
+		return u.Stream
+	}
+	return &u.Udp
+}
+
 func (u *UdpAddr)Usability() int {
 	return u.used
 }
@@ -46,7 +162,37 @@ func (u *UdpAddr)UsabilitySet(used int)  {
 	u.used = used
 }
 
-func NewRoute(ipAddr string, udpAddr UdpAddr, token string) *Route {
+func (u *UdpAddr)RTT() time.Duration {
+	return u.stat.srtt
+}
+
+func (u *UdpAddr)Jitter() time.Duration {
+	return u.stat.jitter
+}
+
+func (u *UdpAddr)Loss() float64 {
+	return u.stat.loss
+}
+
+// lower is better, unusable paths score SCORE_MAX
+func (u *UdpAddr)Score() time.Duration {
+	if u.used == 0 {
+		return SCORE_MAX
+	}
+	return u.stat.srtt + 4 * u.stat.jitter + time.Duration(u.stat.loss * float64(LOSS_PENALTY))
+}
+
+// paths over ipv6 usually avoid nat, they are preferred over ipv4 ones
+// unless they score clearly worse
+func (u *UdpAddr)rank() time.Duration {
+	score := u.Score()
+	if score != SCORE_MAX && u.Udp.IP.To4() == nil {
+		score = score * 3 / 4
+	}
+	return score
+}
+
+func NewRoute(ipAddr string, udpAddr UdpAddr, pubKey []byte) *Route {
 	tmNow := time.Now()
 
 	ips, err := ip.ParseIP4(ipAddr)
@@ -55,50 +201,121 @@ func NewRoute(ipAddr string, udpAddr UdpAddr, token string) *Route {
 		return nil
 	}
 	udpAddr.timestamp = tmNow
-	return &Route{IP: ips, Token: token, Udp: []UdpAddr{udpAddr}, timestamp: tmNow}
+	return &Route{IP: ips, PubKey: pubKey, Udp: []UdpAddr{udpAddr}, timestamp: tmNow}
 }
 
-func (r *Route)Usability(dst *net.UDPAddr)  {
+func (r *Route)Usability(dst *net.UDPAddr) bool {
 	for i, _ := range r.Udp {
 		if r.Udp[i].Udp.String() == dst.String() {
 			r.Udp[i].timestamp = time.Now()
 			r.Udp[i].UsabilitySet(1)
 
 			logs.Info("%s udp addr usability %s", r.IP, dst.String())
-			return
+			return true
 		}
 	}
 	logs.Error("can not find udp addr", dst.String())
+	return false
 }
 
+// punched addresses are only known by this node, they are kept across
+// syncs from the transfer
 func (r *Route)SyncAddr(newList []UdpAddr)  {
 	udps := make([]UdpAddr, len(newList))
 	for i, newUdp := range newList {
 		for _, oldUdp := range r.Udp {
-			if newUdp.Typ == oldUdp.Typ && newUdp.Udp.String() == oldUdp.Udp.String() {
+			if newUdp.Typ == oldUdp.Typ && newUdp.Addr().String() == oldUdp.Addr().String() {
 				newUdp.UsabilitySet(oldUdp.Usability())
 				newUdp.timestamp = oldUdp.timestamp
+				newUdp.stat = oldUdp.stat
 			}
 		}
 		udps[i] = newUdp
 	}
+	for _, oldUdp := range r.Udp {
+		if oldUdp.Typ == UDP_PUNCH_T {
+			udps = append(udps, oldUdp)
+		}
+	}
 	r.Udp = udps
 }
 
+// copy the attributes the route owner publishes about itself
+func (r *Route)SyncInfo(n *Route)  {
+	r.IP6 = n.IP6
+	r.PubKey = n.PubKey
+	r.Nat = n.Nat
+	r.Subnets = n.Subnets
+	r.Peers = n.Peers
+	r.TransRTT = n.TransRTT
+	r.Via = n.Via
+	r.Proto = n.Proto
+}
+
 func (r *Route)Clone() *Route {
 	tmNow := time.Now()
 
-	cp := &Route{IP: r.IP, Token: r.Token, timestamp: tmNow}
+	cp := &Route{IP: r.IP, timestamp: tmNow}
+	cp.SyncInfo(r)
 	cp.Udp = make([]UdpAddr, len(r.Udp))
 	copy(cp.Udp, r.Udp)
 
 	for i, _ := range cp.Udp {
 		cp.Udp[i].timestamp = tmNow
 		cp.Udp[i].used = 0
+		cp.Udp[i].stat = pathStat{}
 	}
 	return cp
 }
 
+// pick the best scoring direct path, the current one is only given up
+// for a candidate scoring at least 20% better so paths do not flap;
+// returns whether the path changed
+func (r *Route)selectPath() bool {
+	var cur, best *UdpAddr
+	for i, _ := range r.Udp {
+		v := &r.Udp[i]
+		if v.Typ == UDP_TRANSFER_T || v.used == 0 {
+			continue
+		}
+		if v.Udp.String() == r.path {
+			cur = v
+		}
+		if best == nil || v.rank() < best.rank() {
+			best = v
+		}
+	}
+
+	if best == nil {
+		if r.path == "" {
+			return false
+		}
+		logs.Info("%s path switch %s -> transfer", r.IP, r.path)
+		r.path = ""
+		return true
+	}
+
+	if cur == nil || (cur != best && best.rank() * 5 < cur.rank() * 4) {
+		logs.Info("%s path switch %s -> %s, rtt %s jitter %s loss %.2f", r.IP, r.path,
+			best.Udp.String(), best.RTT(), best.Jitter(), best.Loss())
+		r.path = best.Udp.String()
+		return true
+	}
+	return false
+}
+
+func (r *Route)PathUdpAddr() *UdpAddr {
+	if r.path == "" {
+		return nil
+	}
+	for _, v := range r.Udp {
+		if v.Typ != UDP_TRANSFER_T && v.Udp.String() == r.path {
+			return &v
+		}
+	}
+	return nil
+}
+
 func (r *Route)TransferUdpAddr() *UdpAddr {
 	for _, v := range r.Udp {
 		if v.Typ == UDP_TRANSFER_T {
@@ -117,6 +334,15 @@ func (r *Route)ThroughUdpAddr() *UdpAddr {
 	return nil
 }
 
+func (r *Route)PunchUdpAddr() *UdpAddr {
+	for _, v := range r.Udp {
+		if v.Typ == UDP_PUNCH_T {
+			return &v
+		}
+	}
+	return nil
+}
+
 func (r *Route)LocalUdpAddr() *UdpAddr {
 	for _, v := range r.Udp {
 		if v.Typ == UDP_LOCALADD_T {
@@ -159,13 +385,24 @@ func (r *Route)Decoder(body []byte) *Route {
 
 type RouteCtrl struct {
 	sync.RWMutex
-	drop time.Duration
-	udp  time.Duration
-	list map[ip.IP4]*Route 
+	drop  time.Duration
+	udp   time.Duration
+	list  map[ip.IP4]*Route
+	exit  ip.IP4
+	hold  bool
+	table *Table
+
+	// table versioning, see sync.go
+	epoch   uint64
+	version uint64
+	tombs   map[ip.IP4]tomb
+	horizon uint64
+	changed chan struct{}
 }
 
 func NewRouteCtrl(dropTime time.Duration, udpTime time.Duration) *RouteCtrl {
-	routes := &RouteCtrl{list: make(map[ip.IP4]*Route, 1024), drop: dropTime, udp: udpTime}
+	routes := &RouteCtrl{list: make(map[ip.IP4]*Route, 1024), drop: dropTime, udp: udpTime, table: NewTable(),
+		epoch: uint64(time.Now().UnixNano()), tombs: make(map[ip.IP4]tomb, 64), changed: make(chan struct{}, 1)}
 	go func() {
 		ticker := time.NewTicker(5*time.Second)
 		defer ticker.Stop()
@@ -184,20 +421,80 @@ func (routes *RouteCtrl)timeoutDrop()  {
 
 	now := time.Now()
 	for _, v := range routes.list {
+		udps := make([]UdpAddr, 0, len(v.Udp))
 		for i, _ := range v.Udp {
 			if v.Udp[i].used > 0 && now.Sub(v.Udp[i].timestamp) > routes.udp {
 				v.Udp[i].used = 0
 
 				logs.Error("timeout drop udp addr", v.Udp[i].Udp.String())
 			}
+			if v.Udp[i].Typ == UDP_PUNCH_T && v.Udp[i].used == 0 {
+				logs.Error("timeout drop punch udp addr", v.Udp[i].Udp.String())
+				continue
+			}
+			udps = append(udps, v.Udp[i])
 		}
+		v.Udp = udps
+		v.selectPath()
 
-		if now.Sub(v.timestamp) > routes.drop {
+		if now.Sub(v.timestamp) > routes.drop && routes.hold == false {
 			delete(routes.list, v.IP)
+			routes.bury(v.IP)
 
 			logs.Error("timeout drop route", v.String())
 		}
 	}
+	routes.expire(now)
+	routes.rebuild()
+}
+
+// publish a new routing table from the route list, called with the
+// write lock held; every route owns its address as a host route and the
+// subnets it advertises, a default route is only taken from the chosen
+// exit node
+func (routes *RouteCtrl)rebuild()  {
+	entries := make([]*Entry, 0, len(routes.list))
+	for _, v := range routes.list {
+		r := v.snapshot()
+		metric := r.metric()
+
+		entries = append(entries, &Entry{Prefix: ip.IP4Net{IP: r.IP, PrefixLen: 32},
+			Distance: DISTANCE_HOST, Metric: metric, Route: r})
+
+		if len(r.IP6) == net.IPv6len {
+			entries = append(entries, &Entry{Host6: r.IP6, Distance: DISTANCE_HOST, Metric: metric, Route: r})
+		}
+
+		for _, n := range r.Subnets {
+			distance := DISTANCE_SUBNET
+			if n.PrefixLen == 0 {
+				if r.IP != routes.exit {
+					continue
+				}
+				distance = DISTANCE_DEFAULT
+			}
+			entries = append(entries, &Entry{Prefix: n, Distance: distance, Metric: metric, Route: r})
+		}
+	}
+	routes.table.Replace(entries)
+}
+
+// while the transfer is away routes are not refreshed, they are held
+// instead of timing out and direct paths keep working
+func (routes *RouteCtrl)Hold(hold bool)  {
+	routes.Lock()
+	defer routes.Unlock()
+
+	routes.hold = hold
+}
+
+// take the default route from the given exit node, zero turns it off
+func (routes *RouteCtrl)SetExit(ip4 ip.IP4)  {
+	routes.Lock()
+	defer routes.Unlock()
+
+	routes.exit = ip4
+	routes.rebuild()
 }
 
 func (routes *RouteCtrl)Sync(r Route)  {
@@ -205,16 +502,21 @@ func (routes *RouteCtrl)Sync(r Route)  {
 	defer routes.Unlock()
 
 	routes.updateRoute(r)
+	routes.rebuild()
 }
 
 func (routes *RouteCtrl)updateRoute(r Route)  {
 	oldRoute, _ := routes.list[r.IP]
 	if oldRoute != nil {
 		oldRoute.timestamp = time.Now()
+		oldRoute.SyncInfo(&r)
 		oldRoute.SyncAddr(r.Udp)
+		oldRoute.selectPath()
 	} else {
-		routes.list[r.IP] = r.Clone()
+		oldRoute = r.Clone()
+		routes.list[r.IP] = oldRoute
 	}
+	routes.stamp(oldRoute)
 }
 
 func (routes *RouteCtrl)SyncBatch(r []Route)  {
@@ -224,6 +526,89 @@ func (routes *RouteCtrl)SyncBatch(r []Route)  {
 	for _, v := range r {
 		routes.updateRoute(v)
 	}
+	routes.rebuild()
+}
+
+// record the address a punched path to the route answered from
+func (routes *RouteCtrl)AddPunch(ip4 ip.IP4, addr *net.UDPAddr) bool {
+	routes.Lock()
+	defer routes.Unlock()
+
+	r, _ := routes.list[ip4]
+	if r == nil {
+		return false
+	}
+
+	for i, _ := range r.Udp {
+		if r.Udp[i].Typ == UDP_PUNCH_T {
+			r.Udp[i].Udp = *addr
+			r.Udp[i].timestamp = time.Now()
+			r.Udp[i].used = 1
+			if r.selectPath() {
+				routes.rebuild()
+			}
+			return true
+		}
+	}
+
+	punch := NewUdpAddr(UDP_PUNCH_T, *addr)
+	punch.used = 1
+	r.Udp = append(r.Udp, punch)
+	if r.selectPath() {
+		routes.rebuild()
+	}
+
+	logs.Info("%s udp addr punched %s", r.IP, addr.String())
+	return true
+}
+
+func (routes *RouteCtrl)udpAddr(ip4 ip.IP4, addr *net.UDPAddr) (*Route, *UdpAddr) {
+	r, _ := routes.list[ip4]
+	if r == nil {
+		return nil, nil
+	}
+	for i, _ := range r.Udp {
+		if r.Udp[i].Typ != UDP_TRANSFER_T && r.Udp[i].Udp.String() == addr.String() {
+			return r, &r.Udp[i]
+		}
+	}
+	return r, nil
+}
+
+// a ping went out on the path
+func (routes *RouteCtrl)Probe(ip4 ip.IP4, addr *net.UDPAddr)  {
+	routes.Lock()
+	defer routes.Unlock()
+
+	_, u := routes.udpAddr(ip4, addr)
+	if u != nil {
+		u.stat.probe()
+	}
+}
+
+// the pong of the path came back after rtt, returns false when the
+// address is not a known path of the route
+func (routes *RouteCtrl)Measure(ip4 ip.IP4, addr *net.UDPAddr, rtt time.Duration) bool {
+	routes.Lock()
+	defer routes.Unlock()
+
+	r, u := routes.udpAddr(ip4, addr)
+	if u == nil {
+		logs.Error("can not find udp addr", addr.String())
+		return false
+	}
+
+	if u.used == 0 {
+		logs.Info("%s udp addr usability %s", r.IP, addr.String())
+	}
+	u.used = 1
+	u.timestamp = time.Now()
+	u.stat.sample(rtt)
+
+	if r.selectPath() {
+		routes.rebuild()
+	}
+	return true
 }
 
 func (routes *RouteCtrl)Route(ip4 ip.IP4) *Route {
@@ -234,6 +619,16 @@ func (routes *RouteCtrl)Route(ip4 ip.IP4) *Route {
 	return r
 }
 
+// longest prefix match in the published routing table, the entry
+// carries a read only copy of the owner route
+func (routes *RouteCtrl)Lookup(ip4 ip.IP4) *Entry {
+	return routes.table.Lookup(ip4)
+}
+
+func (routes *RouteCtrl)Lookup6(ip6 ip.IP6) *Entry {
+	return routes.table.Lookup6(ip6)
+}
+
 func (routes *RouteCtrl)Export() RouteList {
 	routes.RLock()
 	defer routes.RUnlock()
@@ -270,3 +665,239 @@ func (r RouteList)String() string {
 	return string(r.Coder())
 }
 
+// hole punching rendezvous, a gateway asks the transfer to introduce it
+// to a peer, the transfer tells both sides the reflexive address of
+// the other one
+type Punch struct {
+	From ip.IP4
+	To   ip.IP4
+	Addr *net.UDPAddr
+}
+
+func PunchDecoder(body []byte) *Punch {
+	punch := new(Punch)
+	err := json.Unmarshal(body, punch)
+	if err != nil {
+		logs.Error("json unmarshal fail", string(body), err.Error())
+		return nil
+	}
+	return punch
+}
+
+func (p *Punch)Coder() []byte {
+	body, err := json.Marshal(p)
+	if err != nil {
+		logs.Error(err.Error())
+		return nil
+	}
+	return body
+}
+
+// a gateway shutting down gives its address up, transfers withdraw the
+// route at once instead of waiting for it to time out
+type Leave struct {
+	IP     ip.IP4
+	PubKey []byte
+	Proof  []byte `json:",omitempty"`
+}
+
+func (l *Leave)Claim() []byte {
+	return KeyClaim(l.IP, l.PubKey)
+}
+
+// registers and leaves bind an address to the static key of a node, the
+// node proves it holds the key toward the static key of the transfer;
+// the labels keep a proof of one from passing for the other
+const (
+	PROOF_REGISTER = "easymesh register"
+	PROOF_LEAVE    = "easymesh leave"
+)
+
+func KeyClaim(ip4 ip.IP4, pubKey []byte) []byte {
+	claim := make([]byte, 4, 4 + len(pubKey))
+	binary.BigEndian.PutUint32(claim, uint32(ip4))
+	return append(claim, pubKey...)
+}
+
+func LeaveDecoder(body []byte) *Leave {
+	leave := new(Leave)
+	err := json.Unmarshal(body, leave)
+	if err != nil {
+		logs.Error("json unmarshal fail", string(body), err.Error())
+		return nil
+	}
+	return leave
+}
+
+func (l *Leave)Coder() []byte {
+	body, err := json.Marshal(l)
+	if err != nil {
+		logs.Error(err.Error())
+		return nil
+	}
+	return body
+}
+
+
+
+// nat type detection, the transfer answers with the address it saw the
+// probe coming from, from another instance socket when Alt is asked and
+// from a cluster peer on another host when Peer is asked; AltPort is
+// the port of the instance serving the same namespace next to it, zero
+// when there is none, Cluster tells a peer host is there to answer
+type Probe struct {
+	Seq     uint64
+	Alt     bool
+	Mapped  *net.UDPAddr
+	AltPort int  `json:",omitempty"`
+	Peer    bool `json:",omitempty"`
+	Cluster bool `json:",omitempty"`
+}
+
+func ProbeDecoder(body []byte) *Probe {
+	probe := new(Probe)
+	err := json.Unmarshal(body, probe)
+	if err != nil {
+		logs.Error("json unmarshal fail", string(body), err.Error())
+		return nil
+	}
+	return probe
+}
+
+func (p *Probe)Coder() []byte {
+	body, err := json.Marshal(p)
+	if err != nil {
+		logs.Error(err.Error())
+		return nil
+	}
+	return body
+}
+
+// virtual address lease, a gateway asks with its public key and the
+// transfer answers with the address and the pool it belongs to, a zero
+// address when the pool is exhausted
+type Lease struct {
+	PubKey []byte
+	IP     ip.IP4
+	Net    ip.IP4Net
+}
+
+func LeaseDecoder(body []byte) *Lease {
+	lease := new(Lease)
+	err := json.Unmarshal(body, lease)
+	if err != nil {
+		logs.Error("json unmarshal fail", string(body), err.Error())
+		return nil
+	}
+	return lease
+}
+
+func (l *Lease)Coder() []byte {
+	body, err := json.Marshal(l)
+	if err != nil {
+		logs.Error(err.Error())
+		return nil
+	}
+	return body
+}
+
+// the leases a transfer handed out, replicated to its cluster peers so
+// that none of them leases the same address to another key
+type LeaseRecord struct {
+	PubKey []byte
+	IP     ip.IP4
+	Seen   time.Time
+	Static bool `json:",omitempty"`
+}
+
+type LeaseList []LeaseRecord
+
+func LeaseListDecoder(body []byte) LeaseList {
+	var list []LeaseRecord
+	err := json.Unmarshal(body, &list)
+	if err != nil {
+		logs.Error("json unmarshal fail", string(body), err.Error())
+		return nil
+	}
+	return list
+}
+
+func (l LeaseList)Coder() []byte {
+	body, err := json.Marshal(l)
+	if err != nil {
+		logs.Error(err.Error())
+		return nil
+	}
+	return body
+}
+
+// split into lists of about size bytes each, see RouteList.Chunks
+func (l LeaseList)Chunks(size int) []LeaseList {
+	chunks := make([]LeaseList, 0, 1)
+	chunk := make(LeaseList, 0)
+	used := 0
+	for _, v := range l {
+		n := len(LeaseList{v}.Coder())
+		if len(chunk) > 0 && used + n > size {
+			chunks = append(chunks, chunk)
+			chunk = make(LeaseList, 0)
+			used = 0
+		}
+		chunk = append(chunk, v)
+		used += n
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+type ERROR_CODE int
+
+const (
+	_ ERROR_CODE = iota
+	ERROR_IP_CONFLICT
+	ERROR_KEY_PROOF
+)
+
+func (c ERROR_CODE)String() string {
+	switch c {
+	case ERROR_IP_CONFLICT:return "ip conflict"
+	case ERROR_KEY_PROOF:return "key proof"
+	default:
+		return "unknown"
+	}
+}
+
+// a request the transfer refuses, sent back to the gateway; a register
+// refused for its key proof carries the static key of the transfer to
+// prove it toward
+type Error struct {
+	Code   ERROR_CODE
+	IP     ip.IP4
+	Reason string
+	PubKey []byte `json:",omitempty"`
+}
+
+func ErrorDecoder(body []byte) *Error {
+	e := new(Error)
+	err := json.Unmarshal(body, e)
+	if err != nil {
+		logs.Error("json unmarshal fail", string(body), err.Error())
+		return nil
+	}
+	return e
+}
+
+func (e *Error)Coder() []byte {
+	body, err := json.Marshal(e)
+	if err != nil {
+		logs.Error(err.Error())
+		return nil
+	}
+	return body
+}
+
+func (e *Error)Error() string {
+	return e.Code.String() + " " + e.IP.String() + ", " + e.Reason
+}
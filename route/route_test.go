@@ -0,0 +1,87 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/easymesh/easymesh/util/ip"
+	"testing"
+	"time"
+)
+
+func TestPunchWorth(t *testing.T)  {
+	cases := []struct {
+		a    NAT_TYPE
+		b    NAT_TYPE
+		want bool
+	}{
+		{NAT_NONE, NAT_SYMMETRIC, true},
+		{NAT_FULL_CONE, NAT_SYMMETRIC, true},
+		{NAT_SYMMETRIC, NAT_FULL_CONE, true},
+		{NAT_RESTRICTED, NAT_SYMMETRIC, true},
+		{NAT_PORT_RESTRICTED, NAT_PORT_RESTRICTED, true},
+		{NAT_PORT_RESTRICTED, NAT_SYMMETRIC, false},
+		{NAT_SYMMETRIC, NAT_PORT_RESTRICTED, false},
+		{NAT_SYMMETRIC, NAT_SYMMETRIC, false},
+		{NAT_UNKNOWN, NAT_SYMMETRIC, true},
+	}
+
+	for _, c := range cases {
+		got := PunchWorth(c.a, c.b)
+		if got != c.want {
+			t.Errorf("punch %s <-> %s got %v, want %v", c.a.String(), c.b.String(), got, c.want)
+		}
+	}
+
+	if NAT_FULL_CONE.String() != "full cone" || NAT_FULL_CONE != 2 {
+		t.Errorf("full cone is %d %s, want 2 full cone", NAT_FULL_CONE, NAT_FULL_CONE.String())
+	}
+}
+
+// leases of the same encoded size, so chunk boundaries are known
+func testLeases(n int) LeaseList {
+	seen := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	list := make(LeaseList, 0, n)
+	for i := 0; i < n; i++ {
+		list = append(list, LeaseRecord{PubKey: bytes.Repeat([]byte{byte(i)}, 32),
+			IP: ip.MustParseIP4(fmt.Sprintf("172.168.0.%d", 10 + i)), Seen: seen, Static: true})
+	}
+	return list
+}
+
+func TestLeaseListChunks(t *testing.T)  {
+	l := len(testLeases(1).Coder())
+
+	cases := []struct {
+		name   string
+		size   int
+		leases int
+		want   []int
+	}{
+		{"empty", CHUNK_SIZE, 0, []int{}},
+		{"one lease", CHUNK_SIZE, 1, []int{1}},
+		{"size of two leases", 2 * l, 4, []int{2, 2}},
+		{"one byte short of two leases", 2 * l - 1, 3, []int{1, 1, 1}},
+		{"smaller than a lease", l / 2, 2, []int{1, 1}},
+	}
+
+	for _, c := range cases {
+		list := testLeases(c.leases)
+		chunks := list.Chunks(c.size)
+		if len(chunks) != len(c.want) {
+			t.Errorf("%s: %d chunks, want %d", c.name, len(chunks), len(c.want))
+			continue
+		}
+
+		var got LeaseList
+		for i, chunk := range chunks {
+			if len(chunk) != c.want[i] {
+				t.Errorf("%s: chunk %d has %d leases, want %d", c.name, i, len(chunk), c.want[i])
+			}
+			got = append(got, LeaseListDecoder(chunk.Coder())...)
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(list[:len(got)]) || len(got) != len(list) {
+			t.Errorf("%s: decoded %v, want %v", c.name, got, list)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/util/ip"
+	"hash/fnv"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// table versioning: a route takes the next version of the table when
+// what its owner publishes changes, a route gone leaves a tombstone for
+// a while; a gateway holding version N is sent the routes changed after
+// N and the addresses withdrawn since, the full table when the
+// tombstones do not reach back that far
+const TOMB_TIME = 10 * time.Minute
+
+// body bytes of a chunk, a route or a sync never depends on one large
+// datagram
+const CHUNK_SIZE = 1024
+
+type tomb struct {
+	version uint64
+	at      time.Time
+}
+
+// rtt in power of two steps of 4ms, so jitter does not count as change
+func rttBucket(rtt time.Duration) int {
+	return bits.Len64(uint64(rtt / (4 * time.Millisecond)))
+}
+
+// what gateways take from a route, the links are left out as the
+// transfer turns them into relay proposals of its own; the addresses
+// come in any order, a gateway syncing over ipv4 and ipv6 turns them
+// around every time
+func (r *Route)digest() uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%s|%x|%d|%d|%d|", r.IP.String(), r.IP6.String(), r.PubKey, r.Nat, rttBucket(r.TransRTT), r.Proto)
+
+	udps := make([]string, 0, len(r.Udp))
+	for _, v := range r.Udp {
+		if v.Typ == UDP_PUNCH_T {
+			continue
+		}
+		udps = append(udps, fmt.Sprintf("%d %s|", v.Typ, v.Addr().String()))
+	}
+	sort.Strings(udps)
+	for _, v := range udps {
+		h.Write([]byte(v))
+	}
+	for _, n := range r.Subnets {
+		fmt.Fprintf(h, "%s|", n.String())
+	}
+	return h.Sum64()
+}
+
+func (r *Route)Version() uint64 {
+	return r.version
+}
+
+// called with the write lock held
+func (routes *RouteCtrl)stamp(r *Route)  {
+	sum := r.digest()
+	if r.version != 0 && r.sum == sum {
+		return
+	}
+	routes.version++
+	r.version = routes.version
+	r.sum = sum
+	delete(routes.tombs, r.IP)
+	routes.notify()
+}
+
+// called with the write lock held
+func (routes *RouteCtrl)bury(ip4 ip.IP4)  {
+	routes.version++
+	routes.tombs[ip4] = tomb{version: routes.version, at: time.Now()}
+	routes.notify()
+}
+
+// changes coming in a row are told once
+func (routes *RouteCtrl)notify()  {
+	select {
+	case routes.changed <- struct{}{}:
+	default:
+	}
+}
+
+// told when the table takes a new version
+func (routes *RouteCtrl)Changed() <-chan struct{} {
+	return routes.changed
+}
+
+// called with the write lock held
+func (routes *RouteCtrl)expire(now time.Time)  {
+	for k, v := range routes.tombs {
+		if now.Sub(v.at) < TOMB_TIME {
+			continue
+		}
+		if v.version > routes.horizon {
+			routes.horizon = v.version
+		}
+		delete(routes.tombs, k)
+	}
+}
+
+// the route is gone for good, no need to wait for it to time out
+func (routes *RouteCtrl)Withdraw(ip4 ip.IP4)  {
+	routes.Lock()
+	defer routes.Unlock()
+
+	_, ok := routes.list[ip4]
+	if ok == false {
+		return
+	}
+	delete(routes.list, ip4)
+	routes.bury(ip4)
+	routes.rebuild()
+}
+
+// the routes were confirmed without being sent again
+func (routes *RouteCtrl)Refresh(list []ip.IP4)  {
+	routes.Lock()
+	defer routes.Unlock()
+
+	now := time.Now()
+	for _, v := range list {
+		r, _ := routes.list[v]
+		if r != nil {
+			r.timestamp = now
+		}
+	}
+}
+
+// the relay proposals for the routes given, the others are dropped
+func (routes *RouteCtrl)SetRelays(list []ip.IP4, relays []Relay)  {
+	routes.Lock()
+	defer routes.Unlock()
+
+	via := make(map[ip.IP4]ip.IP4, len(relays))
+	for _, v := range relays {
+		via[v.IP] = v.Via
+	}
+	for _, v := range list {
+		r, _ := routes.list[v]
+		if r != nil {
+			r.Via = via[v]
+		}
+	}
+	routes.rebuild()
+}
+
+// a consistent copy of the table and its versions
+type TableView struct {
+	Epoch   uint64
+	Version uint64
+	Routes  RouteList
+
+	tombs   map[ip.IP4]uint64
+	horizon uint64
+}
+
+func (routes *RouteCtrl)View() *TableView {
+	routes.RLock()
+	defer routes.RUnlock()
+
+	view := &TableView{Epoch: routes.epoch, Version: routes.version, horizon: routes.horizon,
+		Routes: make(RouteList, 0, len(routes.list)), tombs: make(map[ip.IP4]uint64, len(routes.tombs))}
+	for _, v := range routes.list {
+		view.Routes = append(view.Routes, *v)
+	}
+	for k, v := range routes.tombs {
+		view.tombs[k] = v.version
+	}
+	return view
+}
+
+// the addresses withdrawn after version since; false when a full table
+// is due: nothing held yet, another table instance, a version from the
+// future or tombstones already gone
+func (view *TableView)Withdrawn(epoch uint64, since uint64) ([]ip.IP4, bool) {
+	if since == 0 || epoch != view.Epoch || since > view.Version || since < view.horizon {
+		return nil, false
+	}
+	list := make([]ip.IP4, 0)
+	for k, v := range view.tombs {
+		if v > since {
+			list = append(list, k)
+		}
+	}
+	return list, true
+}
+
+func (list RouteList)Since(version uint64) RouteList {
+	output := make(RouteList, 0)
+	for _, v := range list {
+		if v.version > version {
+			output = append(output, v)
+		}
+	}
+	return output
+}
+
+// a relay proposal, see RelayFor
+type Relay struct {
+	IP  ip.IP4
+	Via ip.IP4
+}
+
+func (list RouteList)Relays() []Relay {
+	relays := make([]Relay, 0)
+	for _, v := range list {
+		if v.Via != ip.IP4(0) {
+			relays = append(relays, Relay{IP: v.IP, Via: v.Via})
+		}
+	}
+	return relays
+}
+
+// cut the list in chunks of about size bytes, a route larger than that
+// goes alone
+func (list RouteList)Chunks(size int) []RouteList {
+	chunks := make([]RouteList, 0, 1)
+	chunk := make(RouteList, 0)
+	used := 0
+	for _, v := range list {
+		n := len(v.Coder())
+		if len(chunk) > 0 && used + n > size {
+			chunks = append(chunks, chunk)
+			chunk = make(RouteList, 0)
+			used = 0
+		}
+		chunk = append(chunk, v)
+		used += n
+	}
+	if len(chunk) > 0 || len(chunks) == 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// a gateway registers its own route with the table version it holds
+// from the transfer, zero asks for the full table; the transfers not
+// knowing of versions take it for a plain route
+type Register struct {
+	Route
+	Epoch uint64 `json:",omitempty"`
+	Known uint64 `json:",omitempty"`
+	Proof []byte `json:",omitempty"`
+}
+
+// the address and key the register binds, see KeyClaim
+func (reg *Register)Claim() []byte {
+	return KeyClaim(reg.IP, reg.PubKey)
+}
+
+func RegisterDecoder(body []byte) *Register {
+	reg := new(Register)
+	err := json.Unmarshal(body, reg)
+	if err != nil {
+		logs.Error("json unmarshal fail", string(body), err.Error())
+		return nil
+	}
+	return reg
+}
+
+func (reg *Register)Coder() []byte {
+	body, err := json.Marshal(reg)
+	if err != nil {
+		logs.Error(err.Error())
+		return nil
+	}
+	return body
+}
+
+// one chunk of a route sync to a gateway; a full sync (From is zero)
+// replaces all the gateway has from the transfer, a delta carries the
+// routes changed after From and those withdrawn since; the relay
+// proposals are complete in either
+type RouteSync struct {
+	Epoch     uint64
+	From      uint64
+	Version   uint64
+	Chunk     int
+	Chunks    int
+	Routes    RouteList `json:",omitempty"`
+	Withdrawn []ip.IP4  `json:",omitempty"`
+	Relays    []Relay   `json:",omitempty"`
+}
+
+func RouteSyncDecoder(body []byte) *RouteSync {
+	s := new(RouteSync)
+	err := json.Unmarshal(body, s)
+	if err != nil {
+		logs.Error("json unmarshal fail", string(body), err.Error())
+		return nil
+	}
+	return s
+}
+
+func (s *RouteSync)Coder() []byte {
+	body, err := json.Marshal(s)
+	if err != nil {
+		logs.Error(err.Error())
+		return nil
+	}
+	return body
+}
+
+func (s *RouteSync)Full() bool {
+	return s.From == 0
+}
+
+// cut the sync in chunks of about size bytes
+func (s *RouteSync)Split(size int) []*RouteSync {
+	chunks := make([]*RouteSync, 0, 1)
+	chunk := &RouteSync{Epoch: s.Epoch, From: s.From, Version: s.Version}
+	used := 0
+	next := func(n int) {
+		if used > 0 && used + n > size {
+			chunks = append(chunks, chunk)
+			chunk = &RouteSync{Epoch: s.Epoch, From: s.From, Version: s.Version}
+			used = 0
+		}
+		used += n
+	}
+
+	for _, v := range s.Routes {
+		next(len(v.Coder()))
+		chunk.Routes = append(chunk.Routes, v)
+	}
+	for _, v := range s.Withdrawn {
+		next(20)
+		chunk.Withdrawn = append(chunk.Withdrawn, v)
+	}
+	for _, v := range s.Relays {
+		next(40)
+		chunk.Relays = append(chunk.Relays, v)
+	}
+	chunks = append(chunks, chunk)
+
+	for i, v := range chunks {
+		v.Chunk = i
+		v.Chunks = len(chunks)
+	}
+	return chunks
+}
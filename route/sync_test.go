@@ -0,0 +1,80 @@
+package route
+
+import (
+	"fmt"
+	"github.com/easymesh/easymesh/util/ip"
+	"testing"
+)
+
+// routes of the same encoded size, so chunk boundaries are known
+func testSync(routes int, withdrawn int, relays int) *RouteSync {
+	s := &RouteSync{Epoch: 7, From: 3, Version: 9}
+	for i := 0; i < routes; i++ {
+		s.Routes = append(s.Routes, Route{IP: ip.MustParseIP4(fmt.Sprintf("172.168.0.%d", 10 + i))})
+	}
+	for i := 0; i < withdrawn; i++ {
+		s.Withdrawn = append(s.Withdrawn, ip.MustParseIP4(fmt.Sprintf("172.168.1.%d", 10 + i)))
+	}
+	for i := 0; i < relays; i++ {
+		s.Relays = append(s.Relays, Relay{IP: ip.MustParseIP4(fmt.Sprintf("172.168.2.%d", 10 + i)), Via: ip.MustParseIP4("172.168.0.1")})
+	}
+	return s
+}
+
+func TestRouteSyncSplit(t *testing.T)  {
+	r := len(testSync(1, 0, 0).Routes[0].Coder())
+
+	cases := []struct {
+		name      string
+		size      int
+		routes    int
+		withdrawn int
+		relays    int
+		// items per chunk
+		want      []int
+	}{
+		{"empty", CHUNK_SIZE, 0, 0, 0, []int{0}},
+		{"one route", CHUNK_SIZE, 1, 0, 0, []int{1}},
+		{"size of two routes", 2 * r, 4, 0, 0, []int{2, 2}},
+		{"one byte short of two routes", 2 * r - 1, 4, 0, 0, []int{1, 1, 1, 1}},
+		{"one byte over two routes", 2 * r + 1, 5, 0, 0, []int{2, 2, 1}},
+		{"route larger than size", r / 2, 3, 0, 0, []int{1, 1, 1}},
+		{"size of three withdrawn", 60, 0, 4, 0, []int{3, 1}},
+		{"size of two relays", 80, 0, 0, 5, []int{2, 2, 1}},
+		{"withdrawn fill the route chunk", r + 40, 1, 3, 0, []int{3, 1}},
+		{"relays after withdrawn", 60, 0, 2, 2, []int{2, 1, 1}},
+		{"all in one chunk", CHUNK_SIZE * 16, 10, 10, 10, []int{30}},
+	}
+
+	for _, c := range cases {
+		s := testSync(c.routes, c.withdrawn, c.relays)
+		chunks := s.Split(c.size)
+
+		if len(chunks) != len(c.want) {
+			t.Errorf("%s: got %d chunks, want %d", c.name, len(chunks), len(c.want))
+			continue
+		}
+
+		joined := &RouteSync{}
+		for i, v := range chunks {
+			if v.Chunk != i || v.Chunks != len(chunks) {
+				t.Errorf("%s: chunk %d numbered %d of %d", c.name, i, v.Chunk, v.Chunks)
+			}
+			if v.Epoch != s.Epoch || v.From != s.From || v.Version != s.Version {
+				t.Errorf("%s: chunk %d lost the versions", c.name, i)
+			}
+			items := len(v.Routes) + len(v.Withdrawn) + len(v.Relays)
+			if items != c.want[i] {
+				t.Errorf("%s: chunk %d holds %d items, want %d", c.name, i, items, c.want[i])
+			}
+			joined.Routes = append(joined.Routes, v.Routes...)
+			joined.Withdrawn = append(joined.Withdrawn, v.Withdrawn...)
+			joined.Relays = append(joined.Relays, v.Relays...)
+		}
+
+		// the chunks put together are the sync in its order
+		if fmt.Sprint(joined.Routes, joined.Withdrawn, joined.Relays) != fmt.Sprint(s.Routes, s.Withdrawn, s.Relays) {
+			t.Errorf("%s: chunks put together differ from the sync", c.name)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package route
+
+import (
+	"github.com/easymesh/easymesh/util/ip"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// administrative distance, among routes for the same prefix the lower
+// distance wins before the metric is compared
+const (
+	DISTANCE_HOST    uint8 = 0
+	DISTANCE_SUBNET  uint8 = 20
+	DISTANCE_DEFAULT uint8 = 200
+)
+
+// metric added to routes without a direct path, they are relayed by the
+// transfer
+const METRIC_RELAY = 100 * time.Millisecond
+
+type Entry struct {
+	Prefix   ip.IP4Net
+	// ipv6 overlay addresses are host routes only, kept apart from the trie
+	Host6    ip.IP6
+	Distance uint8
+	Metric   uint32
+
+	// read only copy of the owner route taken when the table was built
+	Route    *Route
+}
+
+func (e *Entry)better(other *Entry) bool {
+	if e.Distance != other.Distance {
+		return e.Distance < other.Distance
+	}
+	if e.Metric != other.Metric {
+		return e.Metric < other.Metric
+	}
+	return e.Route.IP < other.Route.IP
+}
+
+type trieNode struct {
+	prefix ip.IP4Net
+	entry  *Entry
+	child  [2]*trieNode
+}
+
+func prefixBit(ip4 ip.IP4, pos uint) int {
+	return int((uint32(ip4) >> (31 - pos)) & 1)
+}
+
+func commonLen(a ip.IP4Net, b ip.IP4Net) uint {
+	limit := a.PrefixLen
+	if b.PrefixLen < limit {
+		limit = b.PrefixLen
+	}
+	var n uint
+	for n < limit && prefixBit(a.IP, n) == prefixBit(b.IP, n) {
+		n++
+	}
+	return n
+}
+
+// path compressed binary trie, only built before it gets published so
+// readers never see it change
+func trieInsert(root **trieNode, e *Entry)  {
+	p := root
+	for {
+		node := *p
+		if node == nil {
+			*p = &trieNode{prefix: e.Prefix, entry: e}
+			return
+		}
+
+		common := commonLen(node.prefix, e.Prefix)
+		if common == node.prefix.PrefixLen && common == e.Prefix.PrefixLen {
+			if node.entry == nil || e.better(node.entry) {
+				node.entry = e
+			}
+			return
+		}
+
+		if common == node.prefix.PrefixLen {
+			p = &node.child[prefixBit(e.Prefix.IP, common)]
+			continue
+		}
+
+		split := &trieNode{prefix: ip.IP4Net{IP: e.Prefix.IP, PrefixLen: common}.Network()}
+		split.child[prefixBit(node.prefix.IP, common)] = node
+		if common == e.Prefix.PrefixLen {
+			split.entry = e
+		} else {
+			split.child[prefixBit(e.Prefix.IP, common)] = &trieNode{prefix: e.Prefix, entry: e}
+		}
+		*p = split
+		return
+	}
+}
+
+func (node *trieNode)lookup(ip4 ip.IP4) *Entry {
+	var best *Entry
+	for node != nil && node.prefix.Contains(ip4) {
+		if node.entry != nil {
+			best = node.entry
+		}
+		if node.prefix.PrefixLen == 32 {
+			break
+		}
+		node = node.child[prefixBit(ip4, node.prefix.PrefixLen)]
+	}
+	return best
+}
+
+type trieRoot struct {
+	node   *trieNode
+	hosts6 map[string]*Entry
+	size   int
+}
+
+// longest prefix match routing table; writers build a new trie and
+// publish it at once, lookups on the packet path take no lock
+type Table struct {
+	snap atomic.Value
+}
+
+func NewTable() *Table {
+	t := new(Table)
+	t.snap.Store(&trieRoot{hosts6: make(map[string]*Entry)})
+	return t
+}
+
+func (t *Table)Replace(entries []*Entry)  {
+	root := &trieRoot{hosts6: make(map[string]*Entry), size: len(entries)}
+	for _, e := range entries {
+		if len(e.Host6) != 0 {
+			key := string(net.IP(e.Host6).To16())
+			old, _ := root.hosts6[key]
+			if old == nil || e.better(old) {
+				root.hosts6[key] = e
+			}
+			continue
+		}
+		e.Prefix = e.Prefix.Network()
+		trieInsert(&root.node, e)
+	}
+	t.snap.Store(root)
+}
+
+func (t *Table)Lookup(ip4 ip.IP4) *Entry {
+	return t.snap.Load().(*trieRoot).node.lookup(ip4)
+}
+
+func (t *Table)Lookup6(ip6 ip.IP6) *Entry {
+	e, _ := t.snap.Load().(*trieRoot).hosts6[string(net.IP(ip6).To16())]
+	return e
+}
+
+func (t *Table)Len() int {
+	return t.snap.Load().(*trieRoot).size
+}
+
+func durationMetric(d time.Duration) uint32 {
+	us := d / time.Microsecond
+	if us < 0 {
+		return 0
+	}
+	if us > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(us)
+}
+
+// metric of reaching the route owner in microseconds, the score of the
+// direct path or the transfer round trip plus the relay penalty
+func (r *Route)metric() uint32 {
+	path := r.PathUdpAddr()
+	if path != nil {
+		return durationMetric(path.Score())
+	}
+	return durationMetric(r.TransRTT + METRIC_RELAY)
+}
+
+func (r *Route)snapshot() *Route {
+	cp := *r
+	cp.Udp = make([]UdpAddr, len(r.Udp))
+	copy(cp.Udp, r.Udp)
+	return &cp
+}
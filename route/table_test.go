@@ -0,0 +1,110 @@
+package route
+
+import (
+	"github.com/easymesh/easymesh/util/ip"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// the host bits of the prefix are kept, Replace masks them
+func testEntry(prefix string, owner string, distance uint8, metric uint32) *Entry {
+	parts := strings.SplitN(prefix, "/", 2)
+	plen, err := strconv.Atoi(parts[1])
+	if err != nil {
+		panic(err)
+	}
+	n, err := ip.NewIP4Net(parts[0], uint(plen))
+	if err != nil {
+		panic(err)
+	}
+	return &Entry{Prefix: *n, Distance: distance, Metric: metric, Route: &Route{IP: ip.MustParseIP4(owner)}}
+}
+
+func testEntries() []*Entry {
+	return []*Entry{
+		testEntry("0.0.0.0/0", "172.168.0.1", DISTANCE_DEFAULT, 0),
+		testEntry("10.0.0.0/8", "172.168.0.2", DISTANCE_SUBNET, 0),
+		testEntry("10.1.9.9/16", "172.168.0.3", DISTANCE_SUBNET, 0),
+		testEntry("10.1.2.3/32", "172.168.0.4", DISTANCE_HOST, 0),
+		testEntry("10.1.2.4/32", "172.168.0.5", DISTANCE_HOST, 10),
+		testEntry("10.1.2.4/32", "172.168.0.6", DISTANCE_HOST, 5),
+		testEntry("10.1.3.0/24", "172.168.0.7", DISTANCE_SUBNET, 1),
+		testEntry("10.1.3.0/24", "172.168.0.8", DISTANCE_HOST, 9),
+		testEntry("255.255.255.255/32", "172.168.0.9", DISTANCE_HOST, 0),
+	}
+}
+
+func TestTableLookup(t *testing.T)  {
+	cases := []struct {
+		name  string
+		addr  string
+		owner string
+	}{
+		{"host route", "10.1.2.3", "172.168.0.4"},
+		{"host route lower metric", "10.1.2.4", "172.168.0.6"},
+		{"host next to host routes", "10.1.2.5", "172.168.0.3"},
+		{"lower distance first", "10.1.3.1", "172.168.0.8"},
+		{"host bits masked", "10.1.200.1", "172.168.0.3"},
+		{"shorter prefix", "10.2.0.1", "172.168.0.2"},
+		{"prefix length 0", "8.8.8.8", "172.168.0.1"},
+		{"prefix length 0 lowest", "0.0.0.0", "172.168.0.1"},
+		{"prefix length 32 highest", "255.255.255.255", "172.168.0.9"},
+		{"prefix length 0 next to highest", "255.255.255.254", "172.168.0.1"},
+	}
+
+	entries := testEntries()
+	reversed := testEntries()
+	for i, j := 0, len(reversed) - 1; i < j; i, j = i + 1, j - 1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+
+	// the trie is the same whatever order the entries come in
+	for _, list := range [][]*Entry{entries, reversed} {
+		table := NewTable()
+		table.Replace(list)
+
+		for _, c := range cases {
+			e := table.Lookup(ip.MustParseIP4(c.addr))
+			if e == nil {
+				t.Errorf("%s: lookup %s got no route", c.name, c.addr)
+				continue
+			}
+			if e.Route.IP.String() != c.owner {
+				t.Errorf("%s: lookup %s got %s, want %s", c.name, c.addr, e.Route.IP.String(), c.owner)
+			}
+		}
+	}
+}
+
+func TestTableLookupMiss(t *testing.T)  {
+	cases := []struct {
+		name    string
+		entries []string
+		addr    string
+	}{
+		{"empty table", nil, "10.1.2.3"},
+		{"no default", []string{"10.0.0.0/8"}, "11.0.0.1"},
+		{"next to host route", []string{"10.1.2.3/32"}, "10.1.2.2"},
+		{"below prefix length 32", []string{"0.0.0.0/32"}, "0.0.0.1"},
+		{"outside of split", []string{"10.1.0.0/16", "10.2.0.0/16"}, "10.3.0.1"},
+	}
+
+	for _, c := range cases {
+		list := make([]*Entry, 0, len(c.entries))
+		for _, prefix := range c.entries {
+			list = append(list, testEntry(prefix, "172.168.0.1", DISTANCE_SUBNET, 0))
+		}
+
+		table := NewTable()
+		table.Replace(list)
+
+		e := table.Lookup(ip.MustParseIP4(c.addr))
+		if e != nil {
+			t.Errorf("%s: lookup %s got %s, want no route", c.name, c.addr, e.Prefix.String())
+		}
+		if table.Len() != len(list) {
+			t.Errorf("%s: table length %d, want %d", c.name, table.Len(), len(list))
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/route"
+	"github.com/easymesh/easymesh/util/udp"
+	"net"
+	"strings"
+	"time"
+)
+
+// transfers on several hosts form a cluster; every instance replicates
+// the routes of the gateways registered with it and the leases it handed
+// out to the instances of the same namespace on the peer hosts, frames
+// toward a gateway registered elsewhere are forwarded to its
+// UDP_TRANSFER_T address
+
+const CLUSTER_SYNC_TIME = 10 * time.Second
+
+var clusterPeers []*net.UDPAddr
+
+func initCluster(peers string) error {
+	for _, v := range strings.Split(peers, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", v)
+		if err != nil {
+			return fmt.Errorf("cluster peer %s is invalid, %s", v, err.Error())
+		}
+		clusterPeers = append(clusterPeers, addr)
+	}
+	if len(clusterPeers) > 0 {
+		logs.Info("cluster peers %v", clusterPeers)
+	}
+	return nil
+}
+
+// the peer instances of the namespace offset ports above the bind port,
+// every host may list the whole cluster including itself
+func (t *Transfer)initPeers(offset int)  {
+	for _, v := range clusterPeers {
+		addr := &net.UDPAddr{IP: v.IP, Port: v.Port + offset, Zone: v.Zone}
+		if addr.String() == t.transAddr.String() {
+			continue
+		}
+		t.peers = append(t.peers, addr)
+	}
+	if len(t.peers) == 0 {
+		return
+	}
+	go t.ReplicateTask()
+
+	// the networks are replicated to the same network on the peers
+	for _, n := range t.networks {
+		n.peers = t.peers
+		go n.ReplicateTask()
+	}
+}
+
+func (t *Transfer)isPeer(addr net.Addr) bool {
+	for _, v := range t.peers {
+		if v.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// a peer instance on another host, it answers nat probes the gateway
+// never sent to its address; peers on our own address tell nothing more
+// than the alt port does
+func (t *Transfer)peerHost() *net.UDPAddr {
+	for _, v := range t.peers {
+		if v.IP.Equal(t.transAddr.IP) == false {
+			return v
+		}
+	}
+	return nil
+}
+
+// ctrl messages for a gateway go to its through address when it is
+// registered with us, else to the transfer it is registered with
+func (t *Transfer)ctrlAddr(r *route.Route) net.Addr {
+	var udpAddr *route.UdpAddr
+	if transferOwner(r, t.transAddr) {
+		udpAddr = r.ThroughUdpAddr()
+	} else {
+		udpAddr = r.TransferUdpAddr()
+	}
+	if udpAddr == nil {
+		return nil
+	}
+	return udpAddr.Addr()
+}
+
+func (t *Transfer)ReplicateTask()  {
+	ticker := time.NewTicker(CLUSTER_SYNC_TIME)
+	defer ticker.Stop()
+
+	for  {
+		<-ticker.C
+		t.replicate()
+	}
+}
+
+// only the routes owned by this instance are sent, peers never pass
+// replicated routes on; the links go with no route, relays are proposed
+// through gateways registered with the same transfer only
+func (t *Transfer)replicate()  {
+	owned := make(route.RouteList, 0)
+	for _, r := range t.routeCtl.Export() {
+		if transferOwner(&r, t.transAddr) {
+			owned = append(owned, r)
+		}
+	}
+	if len(owned) > 0 {
+		// every chunk is a route list of its own, peers take them one by one
+		for _, chunk := range stripPeers(stripStreams(owned)).Chunks(route.CHUNK_SIZE) {
+			t.replicateSend(udp.MSG_REPLICATE, chunk.Coder())
+		}
+	}
+
+	// the leases handed out here go the same way, so no peer leases
+	// their addresses to another key
+	for _, chunk := range leaseStore.Export(t.namespace()).Chunks(route.CHUNK_SIZE) {
+		t.replicateSend(udp.MSG_LEASE, chunk.Coder())
+	}
+}
+
+func (t *Transfer)replicateSend(typ udp.MSG_TYPE, body []byte)  {
+	output := t.ctrlCoder(udp.MSG_VERSION, typ, body)
+	for _, v := range t.peers {
+		err := t.udpSocket.WriteTo(output, v)
+		if err != nil {
+			logs.Error("replicate %s to %s fail, %s", typ.String(), v.String(), err.Error())
+		}
+	}
+}
+
+func (t *Transfer)replicateRoute(srcAddr net.Addr, msg *udp.Msg)  {
+	if t.isPeer(srcAddr) == false {
+		logs.Error("drop replication from unknown transfer", srcAddr.String())
+		return
+	}
+
+	body, seq, err := msg.Open(t.key)
+	if err != nil {
+		logs.Error("replication auth illegal", srcAddr.String(), err.Error())
+		return
+	}
+
+	err = t.replay.Check(srcAddr.String(), seq)
+	if err != nil {
+		logs.Warn("drop replayed replication", srcAddr.String(), err.Error())
+		return
+	}
+
+	list := route.RouteListDecoder(body)
+	if list == nil {
+		logs.Error("replication decoder fail")
+		return
+	}
+
+	// a gateway registered with us as well is served by its own route
+	accept := make([]route.Route, 0, len(list))
+	for _, r := range list {
+		old := t.routeCtl.Lookup(r.IP)
+		if old != nil && old.Route.IP == r.IP && transferOwner(old.Route, t.transAddr) {
+			continue
+		}
+		accept = append(accept, r)
+	}
+	t.routeCtl.SyncBatch(accept)
+
+	logs.Debug("[%s] replicate %d routes from %s", t.String(), len(accept), srcAddr.String())
+}
+
+// a punch notice forwarded by a peer for a gateway registered with us
+func (t *Transfer)punchNotice(conn udp.Transport, srcAddr net.Addr, seq uint64, notice *route.Punch)  {
+	err := t.replay.Check(srcAddr.String(), seq)
+	if err != nil {
+		logs.Warn("drop replayed punch notice", srcAddr.String(), err.Error())
+		return
+	}
+
+	to := t.routeCtl.Route(notice.To)
+	if to == nil || transferOwner(to, t.transAddr) == false {
+		logs.Warn("punch notice for unknown route", notice.To.String())
+		return
+	}
+	toAddr := to.ThroughUdpAddr()
+	if toAddr == nil {
+		return
+	}
+
+	err = conn.WriteTo(t.ctrlCoder(to.Proto, udp.MSG_PUNCH, notice.Coder()), toAddr.Addr())
+	if err != nil {
+		logs.Error("punch notice fail", err.Error())
+	}
+}
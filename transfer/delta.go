@@ -0,0 +1,153 @@
+package main
+
+import (
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/route"
+	"github.com/easymesh/easymesh/util/ip"
+	"github.com/easymesh/easymesh/util/udp"
+	"net"
+	"sync"
+	"time"
+)
+
+// changes of the table are pushed to the gateways registered with us as
+// they happen, a moment is waited for so changes in a row go together
+const PUSH_DELAY = 200 * time.Millisecond
+
+// what a gateway was sent last and the ctrl version it registered in
+type pushed struct {
+	known uint64
+	proto byte
+}
+
+type pushTable struct {
+	sync.Mutex
+	list map[ip.IP4]pushed
+}
+
+func newPushTable() *pushTable {
+	return &pushTable{list: make(map[ip.IP4]pushed, 64)}
+}
+
+func (p *pushTable)Get(ip4 ip.IP4) (pushed, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	v, ok := p.list[ip4]
+	return v, ok
+}
+
+func (p *pushTable)Set(ip4 ip.IP4, v pushed)  {
+	p.Lock()
+	defer p.Unlock()
+
+	p.list[ip4] = v
+}
+
+// gateways registered elsewhere or gone are forgotten
+func (p *pushTable)Keep(owned map[ip.IP4]bool)  {
+	p.Lock()
+	defer p.Unlock()
+
+	for k, _ := range p.list {
+		if owned[k] == false {
+			delete(p.list, k)
+		}
+	}
+}
+
+// gateways have no use for the links of other gateways, they are told
+// the relay proposals instead
+func stripPeers(list route.RouteList) route.RouteList {
+	output := make(route.RouteList, len(list))
+	for i, r := range list {
+		r.Peers = nil
+		output[i] = r
+	}
+	return output
+}
+
+// what the gateway misses of the table, the routes changed after the
+// version it holds, or the full table when that version can not be told
+// apart any more
+func syncFor(view *route.TableView, to ip.IP4, epoch uint64, known uint64) (udp.MSG_TYPE, *route.RouteSync) {
+	list := stripPeers(stripStreams(view.Routes.RelayFor(to)))
+
+	s := &route.RouteSync{Epoch: view.Epoch, Version: view.Version, Relays: list.Relays()}
+
+	withdrawn, ok := view.Withdrawn(epoch, known)
+	if ok == false {
+		s.Routes = list
+		return udp.MSG_ROUTE_UPDATE, s
+	}
+	s.From = known
+	s.Routes = list.Since(known)
+	s.Withdrawn = withdrawn
+	return udp.MSG_ROUTE_DELTA, s
+}
+
+func (t *Transfer)sendSync(conn udp.Transport, dstAddr net.Addr, version byte, to ip.IP4, typ udp.MSG_TYPE, s *route.RouteSync)  {
+	chunks := s.Split(route.CHUNK_SIZE)
+
+	logs.Info("[%s] sync %s to %s, version %d -> %d, %d routes %d withdrawn in %d chunks", t.String(),
+		typ.String(), to.String(), s.From, s.Version, len(s.Routes), len(s.Withdrawn), len(chunks))
+
+	for _, v := range chunks {
+		err := conn.WriteTo(t.ctrlCoder(version, typ, v.Coder()), dstAddr)
+		if err != nil {
+			logs.Error("sync route fail", err.Error())
+			return
+		}
+	}
+}
+
+// answer a register with what the gateway misses of the table
+func (t *Transfer)syncAnswer(conn udp.Transport, dstAddr net.Addr, version byte, reg *route.Register)  {
+	view := t.routeCtl.View()
+	typ, s := syncFor(view, reg.IP, reg.Epoch, reg.Known)
+
+	t.pushed.Set(reg.IP, pushed{known: view.Version, proto: version})
+	t.sendSync(conn, dstAddr, version, reg.IP, typ, s)
+}
+
+func (t *Transfer)PushTask()  {
+	for  {
+		<-t.routeCtl.Changed()
+		time.Sleep(PUSH_DELAY)
+		t.push()
+	}
+}
+
+// every gateway registered with us is sent what changed after the
+// version it was sent last; a gateway missing a push drops the ones
+// after it and catches up by its next register, so does one the
+// tombstones no longer reach back for; gateways speaking the deprecated
+// format wait for their next register as well
+func (t *Transfer)push()  {
+	view := t.routeCtl.View()
+
+	owned := make(map[ip.IP4]bool, len(view.Routes))
+	for _, r := range view.Routes {
+		if transferOwner(&r, t.transAddr) == false {
+			continue
+		}
+		owned[r.IP] = true
+
+		last, ok := t.pushed.Get(r.IP)
+		if ok == false || last.known >= view.Version {
+			continue
+		}
+		addr := r.ThroughUdpAddr()
+		if addr == nil {
+			continue
+		}
+
+		typ, s := syncFor(view, r.IP, view.Epoch, last.known)
+		if typ != udp.MSG_ROUTE_DELTA {
+			continue
+		}
+		t.pushed.Set(r.IP, pushed{known: view.Version, proto: last.proto})
+		t.sendSync(t.udpSocket, addr.Addr(), last.proto, r.IP, typ, s)
+	}
+	t.pushed.Keep(owned)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/route"
+	"github.com/easymesh/easymesh/util/ip"
+	"github.com/easymesh/easymesh/util/udp"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	LEASE_EXPIRE    = 30 * 24 * time.Hour
+	LEASE_SAVE_TIME = time.Minute
+)
+
+// static leases record addresses gateways picked with -ip themselves,
+// peer leases were handed out by a cluster peer and are never passed on
+type Lease struct {
+	IP     ip.IP4
+	Seen   time.Time
+	Static bool `json:",omitempty"`
+	Peer   bool `json:",omitempty"`
+}
+
+// the leases of one namespace, keyed by the node public key
+type LeasePool struct {
+	Leases map[string]*Lease
+	byIP   map[ip.IP4]string
+}
+
+func newLeasePool() *LeasePool {
+	return &LeasePool{Leases: make(map[string]*Lease, 64), byIP: make(map[ip.IP4]string, 64)}
+}
+
+func (p *LeasePool)bind(key string, l *Lease)  {
+	old, ok := p.Leases[key]
+	if ok {
+		delete(p.byIP, old.IP)
+	}
+	p.Leases[key] = l
+	p.byIP[l.IP] = key
+}
+
+// every namespace hands out addresses from the same pool, the leases of
+// all namespaces are persisted to one file keyed by the bind port or
+// the network id
+type LeaseStore struct {
+	sync.Mutex
+	file  string
+	pool  ip.IP4Net
+	pools map[string]*LeasePool
+	dirty bool
+}
+
+var leaseStore *LeaseStore
+
+func initLease(pool string, file string) error {
+	ipn, err := ip.ParseIP4Net(pool)
+	if err != nil {
+		return fmt.Errorf("address pool %s is invalid, %s", pool, err.Error())
+	}
+	if ipn.PrefixLen > 30 {
+		return fmt.Errorf("address pool %s is too small", pool)
+	}
+
+	leaseStore = &LeaseStore{file: file, pool: ipn.Network(), pools: make(map[string]*LeasePool, 64)}
+
+	err = leaseStore.load()
+	if err != nil {
+		return err
+	}
+
+	logs.Info("address pool %s, leases in %s", leaseStore.pool.String(), file)
+
+	go leaseStore.SaveTask()
+	return nil
+}
+
+func (s *LeaseStore)load() error {
+	body, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("lease file %s read fail, %s", s.file, err.Error())
+	}
+
+	var pools map[string]*LeasePool
+	err = json.Unmarshal(body, &pools)
+	if err != nil {
+		return fmt.Errorf("lease file %s is invalid, %s", s.file, err.Error())
+	}
+
+	for ns, v := range pools {
+		p := newLeasePool()
+		for key, l := range v.Leases {
+			// the pool may have changed since
+			if s.pool.Contains(l.IP) == false {
+				continue
+			}
+			p.bind(key, l)
+		}
+		s.pools[ns] = p
+	}
+	return nil
+}
+
+// called with the lock held
+func (s *LeaseStore)save() error {
+	body, err := json.MarshalIndent(s.pools, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	err = ioutil.WriteFile(tmp, body, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, s.file)
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *LeaseStore)SaveTask()  {
+	ticker := time.NewTicker(LEASE_SAVE_TIME)
+	defer ticker.Stop()
+
+	for  {
+		<-ticker.C
+
+		s.Lock()
+		if s.dirty {
+			err := s.save()
+			if err != nil {
+				logs.Error("lease save fail", err.Error())
+			}
+		}
+		s.Unlock()
+	}
+}
+
+func (s *LeaseStore)poolOf(ns string) *LeasePool {
+	p, ok := s.pools[ns]
+	if ok == false {
+		p = newLeasePool()
+		s.pools[ns] = p
+	}
+	return p
+}
+
+// the address leased to the key, a new one is taken from the free part
+// of the pool, addresses in use by a route are skipped; when the pool
+// runs out the longest unseen expired lease is taken over
+func (s *LeaseStore)Acquire(ns string, pubKey []byte, inUse func(ip.IP4) bool) (ip.IP4, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := base64.StdEncoding.EncodeToString(pubKey)
+	p := s.poolOf(ns)
+
+	now := time.Now()
+	l, ok := p.Leases[key]
+	if ok {
+		l.Seen = now
+		l.Peer = false
+		s.dirty = true
+		return l.IP, nil
+	}
+
+	var found ip.IP4
+	first := s.pool.IP + 1
+	last := (s.pool.IP | ip.IP4(^s.pool.Mask())) - 1
+	for v := first; v <= last; v++ {
+		_, used := p.byIP[v]
+		if used || inUse(v) {
+			continue
+		}
+		found = v
+		break
+	}
+
+	if found == ip.IP4(0) {
+		var oldest string
+		for k, v := range p.Leases {
+			if now.Sub(v.Seen) < LEASE_EXPIRE || inUse(v.IP) {
+				continue
+			}
+			if oldest == "" || v.Seen.Before(p.Leases[oldest].Seen) {
+				oldest = k
+			}
+		}
+		if oldest == "" {
+			return ip.IP4(0), fmt.Errorf("address pool %s is exhausted", s.pool.String())
+		}
+		found = p.Leases[oldest].IP
+		delete(p.Leases, oldest)
+		delete(p.byIP, found)
+	}
+
+	p.bind(key, &Lease{IP: found, Seen: now})
+	err := s.save()
+	if err != nil {
+		logs.Error("lease save fail", err.Error())
+	}
+	return found, nil
+}
+
+// a gateway registered with an address of its own, an address of the
+// pool is kept from being handed out to anybody else
+func (s *LeaseStore)Observe(ns string, pubKey []byte, addr ip.IP4)  {
+	if s.pool.Contains(addr) == false {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	key := base64.StdEncoding.EncodeToString(pubKey)
+	p := s.poolOf(ns)
+
+	l, ok := p.Leases[key]
+	if ok {
+		if l.IP == addr {
+			l.Seen = time.Now()
+			l.Peer = false
+			s.dirty = true
+		}
+		return
+	}
+
+	_, used := p.byIP[addr]
+	if used {
+		return
+	}
+	p.bind(key, &Lease{IP: addr, Seen: time.Now(), Static: true})
+	s.dirty = true
+}
+
+// the leases handed out here, for the cluster peers
+func (s *LeaseStore)Export(ns string) route.LeaseList {
+	s.Lock()
+	defer s.Unlock()
+
+	p := s.poolOf(ns)
+	list := make(route.LeaseList, 0, len(p.Leases))
+	for key, l := range p.Leases {
+		if l.Peer {
+			continue
+		}
+		pubKey, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			continue
+		}
+		list = append(list, route.LeaseRecord{PubKey: pubKey, IP: l.IP, Seen: l.Seen, Static: l.Static})
+	}
+	return list
+}
+
+// take the leases a cluster peer handed out; a key keeps the address it
+// was seen with last, two peers leasing one address to different keys
+// in the same round settle on the lower key everywhere, the other node
+// is refused on its next register
+func (s *LeaseStore)Replicate(ns string, list route.LeaseList) int {
+	s.Lock()
+	defer s.Unlock()
+
+	p := s.poolOf(ns)
+	accept := 0
+	for _, v := range list {
+		if s.pool.Contains(v.IP) == false || len(v.PubKey) == 0 {
+			continue
+		}
+		key := base64.StdEncoding.EncodeToString(v.PubKey)
+
+		l, ok := p.Leases[key]
+		if ok {
+			if v.Seen.After(l.Seen) == false {
+				continue
+			}
+			if l.IP == v.IP {
+				l.Seen = v.Seen
+				s.dirty = true
+				continue
+			}
+		}
+
+		other, used := p.byIP[v.IP]
+		if used && other != key {
+			if other < key {
+				continue
+			}
+			logs.Warn("address %s leased to %s here, to %s by a peer", v.IP.String(), other, key)
+			delete(p.Leases, other)
+		}
+
+		p.bind(key, &Lease{IP: v.IP, Seen: v.Seen, Static: v.Static, Peer: true})
+		s.dirty = true
+		accept++
+	}
+	return accept
+}
+
+// whether the address was handed out to another key than this one
+func (s *LeaseStore)LeasedOther(ns string, pubKey []byte, addr ip.IP4) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	p := s.poolOf(ns)
+	key, used := p.byIP[addr]
+	if used == false || p.Leases[key].Static {
+		return false
+	}
+	return key != base64.StdEncoding.EncodeToString(pubKey)
+}
+
+// whether the address was handed out by a lease, static ones aside
+func (s *LeaseStore)Leased(ns string, addr ip.IP4) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	p := s.poolOf(ns)
+	key, used := p.byIP[addr]
+	return used && p.Leases[key].Static == false
+}
+
+// a replayed lease request is harmless, the same key always gets the
+// same address
+func (t *Transfer)leaseRoute(conn udp.Transport, srcAddr net.Addr, msg *udp.Msg)  {
+	body, seq, err := msg.Open(t.key)
+	if err != nil {
+		logs.Error("lease auth illegal", srcAddr.String(), err.Error())
+		return
+	}
+
+	if t.isPeer(srcAddr) {
+		t.leaseNotice(srcAddr, seq, body)
+		return
+	}
+
+	lease := route.LeaseDecoder(body)
+	if lease == nil || len(lease.PubKey) == 0 {
+		logs.Error("lease decoder fail")
+		return
+	}
+
+	addr, err := leaseStore.Acquire(t.namespace(), lease.PubKey, func(v ip.IP4) bool {
+		return t.routeCtl.Route(v) != nil
+	})
+	if err != nil {
+		logs.Error("[%s] lease fail, %s", t.String(), err.Error())
+	} else {
+		logs.Info("[%s] lease %s to %s", t.String(), addr.String(), srcAddr.String())
+	}
+
+	lease.IP = addr
+	lease.Net = leaseStore.pool
+
+	err = conn.WriteTo(t.ctrlCoder(msg.Version, udp.MSG_LEASE, lease.Coder()), srcAddr)
+	if err != nil {
+		logs.Error("lease answer fail", err.Error())
+	}
+}
+
+// the leases a peer handed out, replicated along with its routes
+func (t *Transfer)leaseNotice(srcAddr net.Addr, seq uint64, body []byte)  {
+	err := t.replay.Check(srcAddr.String(), seq)
+	if err != nil {
+		logs.Warn("drop replayed lease replication", srcAddr.String(), err.Error())
+		return
+	}
+
+	list := route.LeaseListDecoder(body)
+	if list == nil {
+		logs.Error("lease replication decoder fail")
+		return
+	}
+
+	accept := leaseStore.Replicate(t.namespace(), list)
+	logs.Debug("[%s] replicate %d leases from %s", t.String(), accept, srcAddr.String())
+}
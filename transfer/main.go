@@ -1,65 +1,86 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/astaxie/beego/logs"
 	"github.com/easymesh/easymesh/route"
 	"github.com/easymesh/easymesh/util"
+	"github.com/easymesh/easymesh/util/crypt"
 	"github.com/easymesh/easymesh/util/ip"
+	"github.com/easymesh/easymesh/util/stream"
 	"github.com/easymesh/easymesh/util/udp"
 	"net"
 	"os"
+	"sync"
 	"time"
 )
 
 type Transfer struct {
 	routeCtl   *route.RouteCtrl
 	transAddr  *net.UDPAddr
-	udpSocket  *net.UDPConn
-	token       string
+	udpSocket  udp.Transport
+	mux        *stream.Mux
+	key         []byte
+	replay      *crypt.ReplayTable
 	oAddr       ip.IP4
+	alt         *Transfer
+	peers       []*net.UDPAddr
+	pushed      *pushTable
+
+	// named networks on the port, see network.go; network is empty for
+	// the namespace of the port, port is the transfer owning the socket
+	network     string
+	port        *Transfer
+	networks    map[string]*Transfer
+	senders     map[string]sender
+	sendersLock sync.Mutex
 }
 
 
-func (t *Transfer)TransferIP(conn *net.UDPConn, oAddr ip.IP4, srcAddr *net.UDPAddr, buff []byte)  {
-	if len(buff) < ip.MAX_IPHEADER {
+func (t *Transfer)TransferFrame(conn udp.Transport, srcAddr net.Addr, buff []byte)  {
+	if len(buff) < ip.MAX_FRAMEHEADER {
 		logs.Error("udp socket recv length too smail", len(buff))
 		return
 	}
 
-	ip4hdr := ip.IP4HeaderDecoder(buff[:ip.MAX_IPHEADER])
-	var sendBody []byte
-	var err error
+	frameHdr := ip.FrameHeaderDecoder(buff[:ip.MAX_FRAMEHEADER])
+
+	n := t.frameNetwork(srcAddr, frameHdr)
+	if n == nil {
+		logs.Warn("drop frame of no network", frameHdr.String(), srcAddr.String())
+		return
+	}
 
-	dstAddr := t.findRoute(ip4hdr.DAddr)
+	dstAddr := n.findRoute(frameHdr.DAddr)
 	if dstAddr == nil {
-		sendBody, err = ip.ICMPUnreachable(oAddr, ip4hdr, buff[:])
-		if err != nil {
-			logs.Error("ipv4 send unreachable fail", ip4hdr.String(), err.Error())
-			return
-		}
-		dstAddr = srcAddr
-	} else {
-		err = ip4hdr.DecrementTTL()
-		if err != nil {
-			logs.Error("ipv4 ttl is zero", ip4hdr.String(), err.Error())
-			return
-		}
-		ip4hdr.Coder(buff[:ip.MAX_IPHEADER])
-		sendBody = buff
+		logs.Warn("drop frame without route", frameHdr.String(), srcAddr.String())
+		return
 	}
 
-	err = udp.UdpWrite(conn, dstAddr, sendBody)
+	err := frameHdr.DecrementTTL()
+	if err != nil {
+		logs.Error("frame ttl is zero", frameHdr.String(), err.Error())
+		return
+	}
+	frameHdr.Coder(buff[:ip.MAX_FRAMEHEADER])
+
+	err = conn.WriteTo(buff, dstAddr)
 	if err != nil {
 		logs.Error("udp send fail", err.Error())
 	}
 }
 
-func (t *Transfer)UdpRecvTask(conn *net.UDPConn, oAddr ip.IP4)  {
+func (t *Transfer)UdpRecvTask(conn udp.Transport, oAddr ip.IP4)  {
 	buff := make([]byte, 8192 )
 	for  {
-		cnt, srcAddr, err := conn.ReadFromUDP(buff)
+		cnt, srcAddr, err := conn.ReadFrom(buff)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			logs.Error(err.Error())
 			continue
@@ -71,37 +92,86 @@ func (t *Transfer)UdpRecvTask(conn *net.UDPConn, oAddr ip.IP4)  {
 		}
 
 		pktType := ip.IPHeaderType(buff[0])
-		if pktType == ip.IPv4 {
-			t.TransferIP(conn, oAddr, srcAddr, buff[:cnt])
+		if pktType == ip.Sealed || pktType == ip.Handshake {
+			t.TransferFrame(conn, srcAddr, buff[:cnt])
 			continue
 		}
 
-		if pktType == ip.IPCtrl {
-			t.syncRoute(conn, srcAddr, buff[1:cnt])
+		if pktType == ip.IPMsg || pktType == ip.IPCtrl {
+			msg, err := udp.CtrlMsgDecoder(buff[:cnt], udp.MSG_REGISTER)
+			if err != nil {
+				logs.Warn("drop ctrl from %s, %s", srcAddr.String(), err.Error())
+				continue
+			}
+			n := t.networkOf(msg)
+			if n == nil || n.key == nil {
+				logs.Debug("drop ctrl for unknown network %s from %s", msg.Network, srcAddr.String())
+				continue
+			}
+			if msg.Legacy() {
+				if LEGACY == false {
+					logs.Debug("drop deprecated ctrl from %s", srcAddr.String())
+					continue
+				}
+				if legacyPeers.First(srcAddr.String()) {
+					logs.Warn("%s speaks the deprecated ctrl format", srcAddr.String())
+				}
+			}
+
+			switch msg.Type {
+			case udp.MSG_REGISTER:
+				n.syncRoute(conn, srcAddr, msg)
+			case udp.MSG_PUNCH:
+				n.punchRoute(conn, srcAddr, msg)
+			case udp.MSG_PROBE:
+				n.probeRoute(conn, srcAddr, msg)
+			case udp.MSG_LEASE:
+				n.leaseRoute(conn, srcAddr, msg)
+			case udp.MSG_REPLICATE:
+				n.replicateRoute(srcAddr, msg)
+			case udp.MSG_LEAVE:
+				n.leaveRoute(srcAddr, msg)
+			default:
+				logs.Debug("drop ctrl %s version %d from %s", msg.Type.String(), msg.Version, srcAddr.String())
+			}
 			continue
 		}
 	}
 }
 
+// gateways are answered in the format they asked in
+func (t *Transfer)ctrlCoder(version byte, typ udp.MSG_TYPE, body []byte) []byte {
+	return udp.MsgAuthCoder(t.key, version, t.network, typ, body)
+}
+
 func NewTransfer(port int, pubip string, token string) *Transfer {
 	var err error
 
 	trans := new(Transfer)
-	trans.token = token
+	trans.port = trans
+	if token != "" {
+		trans.key = crypt.AuthKey(token)
+	}
+	trans.replay = crypt.NewReplayTable()
+	trans.pushed = newPushTable()
 	trans.routeCtl = route.NewRouteCtrl(time.Minute, time.Minute)
 
-	trans.udpSocket, err = udp.OpenUdp(fmt.Sprintf(":%d", port))
+	conn, err := udp.ListenTransport(fmt.Sprintf(":%d", port))
 	if err != nil {
 		logs.Error(err.Error())
 		return nil
 	}
+	trans.mux = stream.NewMux(conn)
+	trans.udpSocket = trans.mux
 
-	publicIP, err := net.ResolveIPAddr("ip4", pubip)
+	publicIP, err := net.ResolveIPAddr("ip", pubip)
 	if err != nil {
 		logs.Error(err.Error())
 		return nil
 	}
-	trans.oAddr = ip.FromIP(publicIP.IP)
+	if publicIP.IP.To4() != nil {
+		trans.oAddr = ip.FromIP(publicIP.IP)
+	}
 
 	trans.transAddr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", pubip, port))
 	if err != nil {
@@ -109,12 +179,15 @@ func NewTransfer(port int, pubip string, token string) *Transfer {
 		return nil
 	}
 
+	trans.openNetworks()
+
 	go trans.UdpRecvTask(trans.udpSocket, trans.oAddr)
+	go trans.PushTask()
 
 	return trans
 }
 
-func transferOwner(r *route.Route, addr *net.UDPAddr) bool {
+func transferOwner(r *route.Route, addr net.Addr) bool {
 	for _, v:= range r.Udp {
 		if v.Typ == route.UDP_TRANSFER_T &&
 			v.Udp.String() == addr.String() {
@@ -125,16 +198,21 @@ func transferOwner(r *route.Route, addr *net.UDPAddr) bool {
 }
 
 func (t *Transfer)String() string {
+	if t.network != "" {
+		return t.transAddr.String() + "/" + t.network
+	}
 	return t.transAddr.String()
 }
 
-func (t *Transfer)findRoute(ip4 ip.IP4) *net.UDPAddr {
+func (t *Transfer)findRoute(ip4 ip.IP4) net.Addr {
 	var udpAddr *route.UdpAddr
 
-	r := t.routeCtl.Route(ip4)
-	if r == nil {
+	// frames are addressed to gateways, only host routes match
+	e := t.routeCtl.Lookup(ip4)
+	if e == nil || e.Route.IP != ip4 {
 		return nil
 	}
+	r := e.Route
 
 	if transferOwner(r, t.transAddr) == true {
 		udpAddr = r.ThroughUdpAddr()
@@ -143,40 +221,339 @@ func (t *Transfer)findRoute(ip4 ip.IP4) *net.UDPAddr {
 	}
 
 	if udpAddr != nil {
-		return &udpAddr.Udp
+		return udpAddr.Addr()
 	}
 	return nil
 }
 
-func (t *Transfer)syncRoute(conn *net.UDPConn, srcAddr *net.UDPAddr, body []byte)  {
-	r := route.RouteDecoder(body)
-	if r == nil {
+func (t *Transfer)syncRoute(conn udp.Transport, srcAddr net.Addr, msg *udp.Msg)  {
+	body, seq, err := msg.Open(t.key)
+	if err != nil {
+		logs.Error("route sync auth illegal", srcAddr.String(), err.Error())
+		return
+	}
+
+	reg := route.RegisterDecoder(body)
+	if reg == nil {
 		logs.Error("route decoder fail")
 		return
 	}
+	r := &reg.Route
+
+	// versioned registers prove the key, the deprecated ones can not
+	proven := false
+	if msg.Legacy() == false {
+		err = keyPair.CheckProof(r.PubKey, route.PROOF_REGISTER, seq, reg.Claim(), reg.Proof)
+		if err != nil {
+			logs.Debug("[%s] route sync from %s without key proof, %s", t.String(), srcAddr.String(), err.Error())
+		}
+		proven = (err == nil)
+	}
+
+	// a refused node must not move the replay window of the holder
+	refuse := t.conflict(r, proven)
+	if refuse != nil {
+		logs.Error("[%s] refuse route sync from %s, %s", t.String(), srcAddr.String(), refuse.Error())
+
+		err = conn.WriteTo(t.ctrlCoder(msg.Version, udp.MSG_ERROR, refuse.Coder()), srcAddr)
+		if err != nil {
+			logs.Error("route sync refuse fail", err.Error())
+		}
+		return
+	}
 
-	if r.Token != TOKEN {
-		logs.Error("route sync token illegal")
+	err = t.replay.Check(r.IP, seq)
+	if err != nil {
+		logs.Warn("drop replayed route sync", srcAddr.String(), r.IP.String(), err.Error())
 		return
 	}
 
-	through := route.NewUdpAddr(route.UDP_THROUGH_T, *srcAddr)
+	through := route.NewAddr(route.UDP_THROUGH_T, srcAddr)
 	transfer := route.NewUdpAddr(route.UDP_TRANSFER_T, *t.transAddr)
 
 	r.Udp = append(r.Udp, through, transfer)
+
+	// gateways sync over ipv4 and ipv6 alike, the public address seen
+	// over the other family is kept
+	old := t.routeCtl.Lookup(r.IP)
+	if old != nil && old.Route.IP == r.IP && through.Stream == nil {
+		for _, v := range old.Route.Udp {
+			if v.Typ == route.UDP_THROUGH_T && v.Stream == nil && (v.Udp.IP.To4() == nil) != (through.Udp.IP.To4() == nil) {
+				r.Udp = append(r.Udp, route.NewUdpAddr(route.UDP_THROUGH_T, v.Udp))
+			}
+		}
+	}
 	t.routeCtl.Sync(*r)
+	t.port.senderSet(t, srcAddr, r.IP)
+	leaseStore.Observe(t.namespace(), r.PubKey, r.IP)
+
+	if msg.Legacy() {
+		routelist := stripStreams(t.routeCtl.Export().RelayFor(r.IP))
+		output := routelist.Coder()
+
+		logs.Info("[%s] sync route list %s\n", t.String(), string(output))
+
+		err = conn.WriteTo(t.ctrlCoder(msg.Version, udp.MSG_ROUTE_UPDATE, output), srcAddr)
+		if err != nil {
+			logs.Error("sync route fail", err.Error())
+		}
+		return
+	}
+	t.syncAnswer(conn, srcAddr, msg.Version, reg)
+}
 
-	routelist := t.routeCtl.Export()
-	output := routelist.Coder()
+// a virtual ip belongs to the node holding it by a live route or by a
+// lease handed out to it, other nodes claiming it are refused; a node
+// is told by its key only when it proves it holds the key, the
+// deprecated registers can not and never take an address a versioned
+// node holds or was leased, whatever key they name
+func (t *Transfer)conflict(r *route.Route, proven bool) *route.Error {
+	e := t.routeCtl.Lookup(r.IP)
+	if e != nil && e.Route.IP == r.IP && bytes.Equal(e.Route.PubKey, r.PubKey) == false {
+		return &route.Error{Code: route.ERROR_IP_CONFLICT, IP: r.IP, Reason: "held by another node"}
+	}
+	if leaseStore.LeasedOther(t.namespace(), r.PubKey, r.IP) {
+		return &route.Error{Code: route.ERROR_IP_CONFLICT, IP: r.IP, Reason: "leased to another node"}
+	}
+	if proven {
+		return nil
+	}
+	if r.Proto != 0 || (e != nil && e.Route.IP == r.IP && e.Route.Proto != 0) || leaseStore.Leased(t.namespace(), r.IP) {
+		return &route.Error{Code: route.ERROR_KEY_PROOF, IP: r.IP, Reason: "key not proven", PubKey: keyPair.PublicKey()}
+	}
+	return nil
+}
 
-	logs.Info("[%s] sync route list %s\n", t.String(), string(output))
+// a gateway shutting down gives its address up, the route is withdrawn
+// at once and the peers are told; only the node holding the address may
+// give it up, a peer tells of gateways registered with it and is taken
+// at its word
+func (t *Transfer)leaveRoute(srcAddr net.Addr, msg *udp.Msg)  {
+	body, seq, err := msg.Open(t.key)
+	if err != nil {
+		logs.Error("leave auth illegal", srcAddr.String(), err.Error())
+		return
+	}
 
-	err := udp.UdpWrite(conn, srcAddr, udp.UdpCtrl(output))
+	leave := route.LeaveDecoder(body)
+	if leave == nil {
+		logs.Error("leave decoder fail")
+		return
+	}
+
+	e := t.routeCtl.Lookup(leave.IP)
+	if e == nil || e.Route.IP != leave.IP || bytes.Equal(e.Route.PubKey, leave.PubKey) == false {
+		logs.Warn("[%s] drop leave of %s from %s, not the holder", t.String(), leave.IP.String(), srcAddr.String())
+		return
+	}
+
+	// the holder leaves from where it registered and proves its key
+	peer := t.isPeer(srcAddr)
+	if peer == false {
+		if throughAddr(e.Route, srcAddr) == false {
+			logs.Warn("[%s] drop leave of %s from %s, not its address", t.String(), leave.IP.String(), srcAddr.String())
+			return
+		}
+		err = keyPair.CheckProof(leave.PubKey, route.PROOF_LEAVE, seq, leave.Claim(), leave.Proof)
+		if err != nil {
+			logs.Warn("[%s] drop leave of %s from %s, %s", t.String(), leave.IP.String(), srcAddr.String(), err.Error())
+			return
+		}
+	}
+	if peer {
+		err = t.replay.Check(srcAddr.String(), seq)
+	} else {
+		err = t.replay.Check(leave.IP, seq)
+	}
 	if err != nil {
-		logs.Error("sync route fail", err.Error())
+		logs.Warn("drop replayed leave", srcAddr.String(), leave.IP.String(), err.Error())
+		return
+	}
+
+	// a gateway registered with us as well leaves us by itself
+	if peer && transferOwner(e.Route, t.transAddr) {
+		return
+	}
+
+	logs.Info("[%s] %s leaves from %s", t.String(), leave.IP.String(), srcAddr.String())
+	t.routeCtl.Withdraw(leave.IP)
+
+	if peer {
+		return
+	}
+	output := t.ctrlCoder(udp.MSG_VERSION, udp.MSG_LEAVE, body)
+	for _, v := range t.peers {
+		err = t.udpSocket.WriteTo(output, v)
+		if err != nil {
+			logs.Error("leave notice to %s fail, %s", v.String(), err.Error())
+		}
 	}
 }
 
+// rendezvous of a hole punch, both gateways learn the reflexive address
+// of the other one at the same time and start sending toward it
+func (t *Transfer)punchRoute(conn udp.Transport, srcAddr net.Addr, msg *udp.Msg)  {
+	body, seq, err := msg.Open(t.key)
+	if err != nil {
+		logs.Error("punch auth illegal", srcAddr.String(), err.Error())
+		return
+	}
+
+	punch := route.PunchDecoder(body)
+	if punch == nil {
+		logs.Error("punch decoder fail")
+		return
+	}
+
+	if t.isPeer(srcAddr) {
+		t.punchNotice(conn, srcAddr, seq, punch)
+		return
+	}
+
+	err = t.replay.Check(punch.From, seq)
+	if err != nil {
+		logs.Warn("drop replayed punch", srcAddr.String(), punch.From.String(), err.Error())
+		return
+	}
+
+	from := t.routeCtl.Route(punch.From)
+	to := t.routeCtl.Route(punch.To)
+	if from == nil || to == nil {
+		logs.Warn("punch between unknown routes", string(body))
+		return
+	}
+
+	// a gateway reached by a stream has no reflexive address to punch
+	fromAddr := from.ThroughUdpAddr()
+	toAddr := to.ThroughUdpAddr()
+	if fromAddr == nil || toAddr == nil || fromAddr.Stream != nil || toAddr.Stream != nil {
+		logs.Warn("punch between routes without through udp address", string(body))
+		return
+	}
+
+	logs.Info("[%s] punch %s(%s) <-> %s(%s)", t.String(),
+		punch.From.String(), fromAddr.Udp.String(), punch.To.String(), toAddr.Udp.String())
+
+	// a gateway registered with a peer transfer gets its notice by way
+	// of that transfer, peers take either format
+	notices := []struct{
+		dst    net.Addr
+		proto  byte
+		notice route.Punch
+	}{
+		{t.ctrlAddr(from), from.Proto, route.Punch{From: punch.To, To: punch.From, Addr: &toAddr.Udp}},
+		{t.ctrlAddr(to), to.Proto, route.Punch{From: punch.From, To: punch.To, Addr: &fromAddr.Udp}},
+	}
+
+	for _, v := range notices {
+		if v.dst == nil {
+			continue
+		}
+		err = conn.WriteTo(t.ctrlCoder(v.proto, udp.MSG_PUNCH, v.notice.Coder()), v.dst)
+		if err != nil {
+			logs.Error("punch notice fail", err.Error())
+		}
+	}
+}
+
+// nat type detection for a gateway, answer with the address the probe
+// came from; a probe is harmless to replay, it only tells the sender
+// its own mapped address
+func (t *Transfer)probeRoute(conn udp.Transport, srcAddr net.Addr, msg *udp.Msg)  {
+	body, seq, err := msg.Open(t.key)
+	if err != nil {
+		logs.Error("probe auth illegal", srcAddr.String(), err.Error())
+		return
+	}
+
+	probe := route.ProbeDecoder(body)
+	if probe == nil {
+		logs.Error("probe decoder fail")
+		return
+	}
+
+	if t.isPeer(srcAddr) {
+		t.probeNotice(srcAddr, seq, probe)
+		return
+	}
+
+	// a stream is not mapped by any nat the gateway could learn of
+	mapped, ok := srcAddr.(*net.UDPAddr)
+	if ok == false {
+		logs.Debug("drop probe from %s", srcAddr.String())
+		return
+	}
+	probe.Mapped = mapped
+
+	// the peer host answers in our place, the gateway never sent to it
+	peer := t.peerHost()
+	probe.Cluster = peer != nil
+	if probe.Peer {
+		if peer == nil {
+			logs.Debug("drop peer probe from %s, no peer host", srcAddr.String())
+			return
+		}
+		err = t.udpSocket.WriteTo(t.ctrlCoder(udp.MSG_VERSION, udp.MSG_PROBE, probe.Coder()), peer)
+		if err != nil {
+			logs.Error("probe forward to %s fail, %s", peer.String(), err.Error())
+		}
+		return
+	}
+
+	if probe.Alt && t.alt != nil && t.alt != t.port {
+		conn = t.alt.udpSocket
+	} else {
+		probe.Alt = false
+	}
+
+	alt := t.altNamespace()
+	if alt != nil {
+		probe.AltPort = alt.transAddr.Port
+	}
+
+	err = conn.WriteTo(t.ctrlCoder(msg.Version, udp.MSG_PROBE, probe.Coder()), srcAddr)
+	if err != nil {
+		logs.Error("probe answer fail", err.Error())
+	}
+}
+
+// a probe forwarded by a peer, answer the gateway at the address the
+// peer saw; the answer only passes a nat letting in any sender
+func (t *Transfer)probeNotice(srcAddr net.Addr, seq uint64, probe *route.Probe)  {
+	err := t.replay.Check(srcAddr.String(), seq)
+	if err != nil {
+		logs.Warn("drop replayed probe", srcAddr.String(), err.Error())
+		return
+	}
+
+	if probe.Peer == false || probe.Mapped == nil {
+		logs.Warn("drop bad probe from peer %s", srcAddr.String())
+		return
+	}
+	probe.Alt, probe.AltPort, probe.Cluster = false, 0, false
+
+	err = t.udpSocket.WriteTo(t.ctrlCoder(udp.MSG_VERSION, udp.MSG_PROBE, probe.Coder()), probe.Mapped)
+	if err != nil {
+		logs.Error("probe answer fail", err.Error())
+	}
+}
+
+// the namespace on the next port, the gateway probes it for a symmetric
+// nat; nil when the port is alone or the namespace is not served there
+func (t *Transfer)altNamespace() *Transfer {
+	if t.alt == nil || t.alt == t.port {
+		return nil
+	}
+	if t.network == "" {
+		if t.alt.key == nil {
+			return nil
+		}
+		return t.alt
+	}
+	n, _ := t.alt.networks[t.network]
+	return n
+}
+
 var (
 	help   bool
 	debug  bool
@@ -188,6 +565,19 @@ var (
 
 	LOG_DIR     string
 	PUB_ADDR    string
+
+	TCP_PORT    int
+	TLS_PORT    int
+	WS_PORT     int
+	WSS_PORT    int
+	CERT_FILE   string
+	CERT_KEY    string
+	PEERS       string
+	POOL        string
+	LEASE_FILE  string
+	LEGACY      bool
+	NETWORKS    string
+	KEY_FILE    string
 )
 
 func init()  {
@@ -198,10 +588,37 @@ func init()  {
 	flag.IntVar(&BIND_PORT, "bind", 8000, "transfer server bind port")
 	flag.IntVar(&BIND_NUMS, "nums", 1000, "transfer server instance nums")
 	flag.StringVar(&PUB_ADDR, "public", "www.domain.com", "public IP")
+	flag.IntVar(&TCP_PORT, "tcp", 0, "tcp fallback listen port, 0 disables")
+	flag.IntVar(&TLS_PORT, "tls", 0, "tls fallback listen port, e.g. 443, 0 disables")
+	flag.IntVar(&WS_PORT, "ws", 0, "websocket listen port, 0 disables")
+	flag.IntVar(&WSS_PORT, "wss", 0, "websocket over tls listen port, 0 disables")
+	flag.StringVar(&CERT_FILE, "cert", "", "tls certificate file, self signed when empty")
+	flag.StringVar(&CERT_KEY, "certkey", "", "tls certificate key file")
+	flag.StringVar(&POOL, "pool", "172.168.0.0/16", "virtual ip pool leased to gateways started without -ip")
+	flag.StringVar(&LEASE_FILE, "lease", "./lease.json", "virtual ip lease file")
+	flag.BoolVar(&LEGACY, "legacy", true, "accept gateways speaking the deprecated ctrl format")
+	flag.StringVar(&NETWORKS, "networks", "", "named networks file, each network with a token and port of its own")
+	flag.StringVar(&KEY_FILE, "key", "./transfer.key", "transfer key pair file, gateways prove their key toward it")
+	flag.StringVar(&PEERS, "peers", "", "cluster peer transfers with their bind port, e.g. 1.2.3.4:8000,5.6.7.8:8000")
 }
 
 var transList []*Transfer
 
+// the static key of the transfer, shared by all instances and networks
+var keyPair *crypt.KeyPair
+
+func initKeyPair(filename string) error {
+	var err error
+	keyPair, err = crypt.LoadKeyPair(filename)
+	if err != nil {
+		return err
+	}
+	logs.Info("transfer key pair load from %s, public key %s", filename, base64.StdEncoding.EncodeToString(keyPair.PublicKey()))
+	return nil
+}
+
+var legacyPeers = udp.NewLegacyPeers()
+
 func main()  {
 	flag.Parse()
 	if help {
@@ -209,23 +626,65 @@ func main()  {
 		return
 	}
 
-	if TOKEN == "" {
+	// with named networks the port namespaces are only open by a token
+	// given
+	if TOKEN == "" && NETWORKS == "" {
 		TOKEN = util.GetToken(32)
 	}
 
-	logs.Info("Token: %s", TOKEN)
+	if TOKEN != "" {
+		logs.Info("Token: %s", TOKEN)
+	}
 
 	util.LogInit(LOG_DIR, debug,"transfer.log")
 
+	err := initKeyPair(KEY_FILE)
+	if err != nil {
+		logs.Error("key pair load fail, %s", err.Error())
+		return
+	}
+
+	err = initNetworks(NETWORKS, BIND_PORT, BIND_NUMS)
+	if err != nil {
+		logs.Error(err.Error())
+		return
+	}
+
+	err = initCluster(PEERS)
+	if err != nil {
+		logs.Error(err.Error())
+		return
+	}
+
+	err = initLease(POOL, LEASE_FILE)
+	if err != nil {
+		logs.Error(err.Error())
+		return
+	}
+
 	for i := BIND_PORT ; i < (BIND_PORT + BIND_NUMS); i++ {
 		temp := NewTransfer(i, PUB_ADDR, TOKEN)
 		if temp != nil {
+			temp.initPeers(i - BIND_PORT)
 			transList = append(transList, temp)
 		} else {
 			logs.Error("bind port %d fail", i)
 		}
 	}
 
+	for i, v := range transList {
+		v.alt = transList[(i + 1) % len(transList)]
+		for _, n := range v.networks {
+			n.alt = v.alt
+		}
+	}
+
+	err = initStream(TCP_PORT, TLS_PORT, WS_PORT, WSS_PORT, CERT_FILE, CERT_KEY)
+	if err != nil {
+		logs.Error("stream listen fail", err.Error())
+		return
+	}
+
 	util.WaitSignal(Shutdown)
 }
 
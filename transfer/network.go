@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/route"
+	"github.com/easymesh/easymesh/util/crypt"
+	"github.com/easymesh/easymesh/util/ip"
+	"github.com/easymesh/easymesh/util/udp"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// named networks: every network has a token of its own and lives on one
+// port next to other networks; its ctrl messages carry the network id,
+// frames belong to the network their sender registered in. The
+// namespace of the port itself is kept for gateways without a network,
+// it takes the global token and is closed when there is none
+
+const SENDER_PRUNE_TIME = time.Minute
+
+type NetworkConf struct {
+	Token string
+	Port  int `json:",omitempty"`
+}
+
+var networkConf map[string]*NetworkConf
+
+// network ids start with a letter, they never clash with the ports
+// keying the leases of the port namespaces
+func networkName(name string) bool {
+	if len(name) == 0 || len(name) > udp.MSG_NETWORK_MAX {
+		return false
+	}
+	for i, c := range name {
+		letter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if i == 0 && letter == false {
+			return false
+		}
+		if letter == false && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// the networks file maps network ids to their token and port, the port
+// defaults to the bind port
+func initNetworks(file string, bindPort int, bindNums int) error {
+	networkConf = make(map[string]*NetworkConf, 16)
+	if file == "" {
+		return nil
+	}
+
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("network file %s read fail, %s", file, err.Error())
+	}
+	err = json.Unmarshal(body, &networkConf)
+	if err != nil {
+		return fmt.Errorf("network file %s is invalid, %s", file, err.Error())
+	}
+
+	for name, v := range networkConf {
+		if networkName(name) == false {
+			return fmt.Errorf("network id %s is invalid", name)
+		}
+		if v == nil || v.Token == "" {
+			return fmt.Errorf("network %s has no token", name)
+		}
+		if v.Port == 0 {
+			v.Port = bindPort
+		}
+		if v.Port < bindPort || v.Port >= bindPort + bindNums {
+			return fmt.Errorf("network %s port %d is out of the bind ports", name, v.Port)
+		}
+	}
+
+	logs.Info("%d networks from %s", len(networkConf), file)
+	return nil
+}
+
+// the networks configured for the port of the transfer share its socket
+func (t *Transfer)openNetworks()  {
+	t.networks = make(map[string]*Transfer, len(networkConf))
+
+	names := make([]string, 0, len(networkConf))
+	for name, v := range networkConf {
+		if v.Port == t.transAddr.Port {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		n := &Transfer{network: name, port: t, transAddr: t.transAddr, udpSocket: t.udpSocket, oAddr: t.oAddr}
+		n.key = crypt.AuthKey(networkConf[name].Token)
+		n.replay = crypt.NewReplayTable()
+		n.pushed = newPushTable()
+		n.routeCtl = route.NewRouteCtrl(time.Minute, time.Minute)
+		t.networks[name] = n
+
+		go n.PushTask()
+	}
+
+	if len(names) > 0 {
+		t.senders = make(map[string]sender, 1024)
+		go t.SenderTask()
+
+		logs.Info("[%s] networks %v", t.String(), names)
+	}
+}
+
+// leases tell namespaces apart by the port or the network id
+func (t *Transfer)namespace() string {
+	if t.network != "" {
+		return t.network
+	}
+	return strconv.Itoa(t.transAddr.Port)
+}
+
+// the transfer of the network a ctrl message is for, nil when unknown
+func (t *Transfer)networkOf(msg *udp.Msg) *Transfer {
+	if msg.Network == "" {
+		return t
+	}
+	n, _ := t.networks[msg.Network]
+	return n
+}
+
+// the gateway addresses frames come from, by the network they
+// registered in; an entry is checked against the route on every use
+type sender struct {
+	n  *Transfer
+	ip ip.IP4
+}
+
+func throughAddr(r *route.Route, addr net.Addr) bool {
+	for _, v := range r.Udp {
+		if v.Typ == route.UDP_THROUGH_T && v.Addr().String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// called for the port transfer as gateways register with one of its
+// namespaces
+func (t *Transfer)senderSet(n *Transfer, addr net.Addr, ip4 ip.IP4)  {
+	if t.senders == nil {
+		return
+	}
+	t.sendersLock.Lock()
+	defer t.sendersLock.Unlock()
+
+	t.senders[addr.String()] = sender{n: n, ip: ip4}
+}
+
+func (t *Transfer)senderOf(addr net.Addr) *Transfer {
+	t.sendersLock.Lock()
+	s, ok := t.senders[addr.String()]
+	t.sendersLock.Unlock()
+
+	if ok == false {
+		return nil
+	}
+	e := s.n.routeCtl.Lookup(s.ip)
+	if e == nil || e.Route.IP != s.ip || throughAddr(e.Route, addr) == false {
+		return nil
+	}
+	return s.n
+}
+
+func (t *Transfer)SenderTask()  {
+	ticker := time.NewTicker(SENDER_PRUNE_TIME)
+	defer ticker.Stop()
+
+	for  {
+		<-ticker.C
+
+		t.sendersLock.Lock()
+		for k, s := range t.senders {
+			e := s.n.routeCtl.Lookup(s.ip)
+			if e == nil || e.Route.IP != s.ip {
+				delete(t.senders, k)
+			}
+		}
+		t.sendersLock.Unlock()
+	}
+}
+
+// frames carry no network; a frame from a gateway belongs to the network
+// the gateway registered in, a frame forwarded by a peer to the network
+// its destination registered with us in and its source with that peer
+func (t *Transfer)frameNetwork(srcAddr net.Addr, hdr *ip.FrameHeader) *Transfer {
+	if len(t.networks) == 0 {
+		return t
+	}
+	if t.isPeer(srcAddr) == false {
+		return t.senderOf(srcAddr)
+	}
+
+	for _, n := range t.namespaces() {
+		dst := n.routeCtl.Lookup(hdr.DAddr)
+		if dst == nil || dst.Route.IP != hdr.DAddr || transferOwner(dst.Route, n.transAddr) == false {
+			continue
+		}
+		src := n.routeCtl.Lookup(hdr.SAddr)
+		if src == nil || src.Route.IP != hdr.SAddr || transferOwner(src.Route, srcAddr) == false {
+			continue
+		}
+		return n
+	}
+	return nil
+}
+
+// the port namespace and the networks on the port
+func (t *Transfer)namespaces() []*Transfer {
+	list := make([]*Transfer, 0, len(t.networks) + 1)
+	list = append(list, t)
+	for _, n := range t.networks {
+		list = append(list, n)
+	}
+	return list
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/route"
+	"github.com/easymesh/easymesh/util/stream"
+	"math/big"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	STREAM_HELLO_TIMEOUT = 10 * time.Second
+	STREAM_MAX           = 4096
+)
+
+var streamCount int32
+
+func findTransfer(port int) *Transfer {
+	for _, v := range transList {
+		if v.transAddr.Port == port {
+			return v
+		}
+	}
+	return nil
+}
+
+// every stream is attached to the transport of the namespace it names
+// and served like the udp socket, until it breaks
+func streamAccept(fc stream.FrameConn)  {
+	if atomic.AddInt32(&streamCount, 1) > STREAM_MAX {
+		atomic.AddInt32(&streamCount, -1)
+		logs.Warn("stream %s refused, too many streams", fc.RemoteAddr().String())
+		fc.Close()
+		return
+	}
+	defer atomic.AddInt32(&streamCount, -1)
+
+	port, err := readHello(fc)
+	if err != nil {
+		logs.Warn("stream %s hello fail, %s", fc.RemoteAddr().String(), err.Error())
+		fc.Close()
+		return
+	}
+
+	t := findTransfer(port)
+	if t == nil {
+		logs.Warn("stream %s names unknown namespace %d", fc.RemoteAddr().String(), port)
+		fc.Close()
+		return
+	}
+
+	conn := t.mux.Attach(fc)
+	logs.Info("[%s] stream %s attached", t.String(), conn.Addr().String())
+
+	t.UdpRecvTask(conn, t.oAddr)
+}
+
+// a connection that never says hello is dropped
+func readHello(fc stream.FrameConn) (int, error) {
+	timer := time.AfterFunc(STREAM_HELLO_TIMEOUT, func() {
+		fc.Close()
+	})
+	defer timer.Stop()
+
+	return stream.ReadHello(fc)
+}
+
+func streamListen(ln net.Listener)  {
+	logs.Info("stream listen on %s", ln.Addr().String())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logs.Error("stream accept fail", err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		go streamAccept(stream.NewStreamConn(conn))
+	}
+}
+
+const WS_PATH = "/mesh"
+
+func webSocketListen(ln net.Listener)  {
+	logs.Info("websocket listen on %s%s", ln.Addr().String(), WS_PATH)
+
+	mux := http.NewServeMux()
+	mux.Handle(WS_PATH, stream.WebSocketHandler(streamAccept))
+
+	err := http.Serve(ln, mux)
+	if err != nil {
+		logs.Error("websocket serve fail", err.Error())
+	}
+}
+
+func initStream(tcpPort int, tlsPort int, wsPort int, wssPort int, certFile string, keyFile string) error {
+	var tlsConfig *tls.Config
+	if tlsPort != 0 || wssPort != 0 {
+		cert, err := loadCertificate(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	listen := func(port int, secure bool) (net.Listener, error) {
+		if secure {
+			return tls.Listen("tcp", fmt.Sprintf(":%d", port), tlsConfig)
+		}
+		return net.Listen("tcp", fmt.Sprintf(":%d", port))
+	}
+
+	listeners := []struct {
+		port   int
+		secure bool
+		serve  func(net.Listener)
+	}{
+		{tcpPort, false, streamListen},
+		{tlsPort, true, streamListen},
+		{wsPort, false, webSocketListen},
+		{wssPort, true, webSocketListen},
+	}
+
+	for _, v := range listeners {
+		if v.port == 0 {
+			continue
+		}
+		ln, err := listen(v.port, v.secure)
+		if err != nil {
+			return err
+		}
+		go v.serve(ln)
+	}
+	return nil
+}
+
+// without a certificate a self signed one is made up, gateways do not
+// rely on it: control messages carry their own authentication and data
+// is sealed end to end
+func loadCertificate(certFile string, keyFile string) (tls.Certificate, error) {
+	if certFile != "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: PUB_ADDR},
+		DNSNames:     []string{PUB_ADDR},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	logs.Info("tls self signed certificate for %s", PUB_ADDR)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// the stream a gateway is reached by means nothing to anybody else
+func stripStreams(list route.RouteList) route.RouteList {
+	output := make(route.RouteList, len(list))
+	for i, r := range list {
+		udps := make([]route.UdpAddr, 0, len(r.Udp))
+		for _, v := range r.Udp {
+			if v.Stream != nil {
+				continue
+			}
+			udps = append(udps, v)
+		}
+		r.Udp = udps
+		output[i] = r
+	}
+	return output
+}
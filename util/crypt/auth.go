@@ -0,0 +1,114 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const AUTH_WINDOW = 2 * time.Minute
+
+// control message envelope, the shared token never goes on the wire,
+// both sides prove they know it by a HMAC over the timestamped body
+type Auth struct {
+	Time int64
+	Seq  uint64
+	Body []byte
+	Mac  []byte
+}
+
+func AuthKey(token string) []byte {
+	return DeriveKey([]byte(token), "easymesh ctrl")
+}
+
+func authMac(key []byte, tm int64, seq uint64, body []byte) []byte {
+	var header [16]byte
+	binary.BigEndian.PutUint64(header[:], uint64(tm))
+	binary.BigEndian.PutUint64(header[8:], seq)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header[:])
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func AuthCoder(key []byte, body []byte) []byte {
+	return AuthSeqCoder(key, NextSequence(), body)
+}
+
+// the sequence number drawn by the caller, for bodies bound to it
+func AuthSeqCoder(key []byte, seq uint64, body []byte) []byte {
+	auth := Auth{Time: time.Now().UnixNano(), Seq: seq, Body: body}
+	auth.Mac = authMac(key, auth.Time, auth.Seq, auth.Body)
+
+	output, err := json.Marshal(&auth)
+	if err != nil {
+		return nil
+	}
+	return output
+}
+
+// returns the authenticated body and its sequence number, the caller
+// checks the sequence against the replay window of the sender
+func AuthDecoder(key []byte, body []byte) ([]byte, uint64, error) {
+	var auth Auth
+	err := json.Unmarshal(body, &auth)
+	if err != nil {
+		return nil, 0, fmt.Errorf("auth envelope decode fail, %s", err.Error())
+	}
+
+	if hmac.Equal(auth.Mac, authMac(key, auth.Time, auth.Seq, auth.Body)) == false {
+		return nil, 0, fmt.Errorf("auth envelope mac illegal")
+	}
+
+	delta := time.Since(time.Unix(0, auth.Time))
+	if delta > AUTH_WINDOW || delta < -AUTH_WINDOW {
+		return nil, 0, fmt.Errorf("auth envelope time out of window %s", delta.String())
+	}
+	return auth.Body, auth.Seq, nil
+}
+
+// binary envelope of the versioned ctrl messages, time and sequence go
+// in front of the body and the mac behind it; the mac also covers the
+// message header handed in as ad, so the type can not be swapped
+const AUTH_OVERHEAD = 16 + sha256.Size
+
+func AuthSeal(key []byte, ad []byte, body []byte) []byte {
+	return AuthSealSeq(key, ad, NextSequence(), body)
+}
+
+func AuthSealSeq(key []byte, ad []byte, seq uint64, body []byte) []byte {
+	output := make([]byte, 16, AUTH_OVERHEAD + len(body))
+	binary.BigEndian.PutUint64(output, uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(output[8:], seq)
+	output = append(output, body...)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(ad)
+	mac.Write(output)
+	return mac.Sum(output)
+}
+
+func AuthOpen(key []byte, ad []byte, body []byte) ([]byte, uint64, error) {
+	if len(body) < AUTH_OVERHEAD {
+		return nil, 0, fmt.Errorf("auth envelope too short %d", len(body))
+	}
+	cnt := len(body) - sha256.Size
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(ad)
+	mac.Write(body[:cnt])
+	if hmac.Equal(body[cnt:], mac.Sum(nil)) == false {
+		return nil, 0, fmt.Errorf("auth envelope mac illegal")
+	}
+
+	tm := int64(binary.BigEndian.Uint64(body))
+	delta := time.Since(time.Unix(0, tm))
+	if delta > AUTH_WINDOW || delta < -AUTH_WINDOW {
+		return nil, 0, fmt.Errorf("auth envelope time out of window %s", delta.String())
+	}
+	return body[16:cnt], binary.BigEndian.Uint64(body[8:]), nil
+}
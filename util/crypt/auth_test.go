@@ -0,0 +1,147 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// an envelope stamped with the time given
+func testAuth(key []byte, tm time.Time, seq uint64, body []byte) []byte {
+	auth := Auth{Time: tm.UnixNano(), Seq: seq, Body: body}
+	auth.Mac = authMac(key, auth.Time, auth.Seq, auth.Body)
+	output, _ := json.Marshal(&auth)
+	return output
+}
+
+func TestAuthDecoder(t *testing.T)  {
+	key := AuthKey("token")
+	now := time.Now()
+
+	tampered := Auth{Time: now.UnixNano(), Seq: 7, Body: []byte("body")}
+	tampered.Mac = authMac(key, tampered.Time, tampered.Seq, tampered.Body)
+	tampered.Body = []byte("bodY")
+	tamperedBody, _ := json.Marshal(&tampered)
+
+	tampered.Body = []byte("body")
+	tampered.Seq = 8
+	tamperedSeq, _ := json.Marshal(&tampered)
+
+	cases := []struct {
+		name string
+		key  []byte
+		body []byte
+		seq  uint64
+		ok   bool
+	}{
+		{"fresh", key, testAuth(key, now, 7, []byte("body")), 7, true},
+		{"empty body", key, testAuth(key, now, 7, nil), 7, true},
+		{"inside window", key, testAuth(key, now.Add(-AUTH_WINDOW + time.Second), 7, []byte("body")), 7, true},
+		{"other token", AuthKey("other"), testAuth(key, now, 7, []byte("body")), 0, false},
+		{"body changed", key, tamperedBody, 0, false},
+		{"sequence changed", key, tamperedSeq, 0, false},
+		{"stale", key, testAuth(key, now.Add(-AUTH_WINDOW - time.Second), 7, []byte("body")), 0, false},
+		{"future", key, testAuth(key, now.Add(AUTH_WINDOW + time.Second), 7, []byte("body")), 0, false},
+		{"no mac", key, []byte(`{"Time":1,"Seq":7,"Body":"Ym9keQ=="}`), 0, false},
+		{"not json", key, []byte("body"), 0, false},
+	}
+
+	for _, c := range cases {
+		body, seq, err := AuthDecoder(c.key, c.body)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v, want ok %v", c.name, err, c.ok)
+			continue
+		}
+		if err == nil && (seq != c.seq || (string(body) != "body" && len(body) != 0)) {
+			t.Errorf("%s: got body %q sequence %d, want sequence %d", c.name, body, seq, c.seq)
+		}
+	}
+
+	// every envelope takes the next sequence number
+	_, first, _ := AuthDecoder(key, AuthCoder(key, nil))
+	_, second, _ := AuthDecoder(key, AuthCoder(key, nil))
+	if second <= first {
+		t.Errorf("sequence %d after %d", second, first)
+	}
+}
+
+// a binary envelope stamped with the time given
+func testSeal(key []byte, ad []byte, tm time.Time, seq uint64, body []byte) []byte {
+	output := make([]byte, 16, AUTH_OVERHEAD + len(body))
+	binary.BigEndian.PutUint64(output, uint64(tm.UnixNano()))
+	binary.BigEndian.PutUint64(output[8:], seq)
+	output = append(output, body...)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(ad)
+	mac.Write(output)
+	return mac.Sum(output)
+}
+
+func TestAuthOpen(t *testing.T)  {
+	key := AuthKey("token")
+	ad := []byte("header")
+	now := time.Now()
+
+	flip := func(pos int) []byte {
+		body := testSeal(key, ad, now, 7, []byte("body"))
+		if pos < 0 {
+			pos += len(body)
+		}
+		body[pos] ^= 1
+		return body
+	}
+
+	cases := []struct {
+		name string
+		key  []byte
+		ad   []byte
+		body []byte
+		ok   bool
+	}{
+		{"fresh", key, ad, testSeal(key, ad, now, 7, []byte("body")), true},
+		{"sealed now", key, ad, AuthSeal(key, ad, []byte("body")), true},
+		{"empty body", key, ad, testSeal(key, ad, now, 7, nil), true},
+		{"inside window", key, ad, testSeal(key, ad, now.Add(AUTH_WINDOW - time.Second), 7, []byte("body")), true},
+		{"other token", AuthKey("other"), ad, testSeal(key, ad, now, 7, []byte("body")), false},
+		{"other header", key, []byte("headeR"), testSeal(key, ad, now, 7, []byte("body")), false},
+		{"time flipped", key, ad, flip(7), false},
+		{"sequence flipped", key, ad, flip(15), false},
+		{"body flipped", key, ad, flip(16), false},
+		{"mac flipped", key, ad, flip(-1), false},
+		{"below overhead", key, ad, testSeal(key, ad, now, 7, nil)[:AUTH_OVERHEAD - 1], false},
+		{"stale", key, ad, testSeal(key, ad, now.Add(-AUTH_WINDOW - time.Second), 7, []byte("body")), false},
+		{"future", key, ad, testSeal(key, ad, now.Add(AUTH_WINDOW + time.Second), 7, []byte("body")), false},
+	}
+
+	for _, c := range cases {
+		body, _, err := AuthOpen(c.key, c.ad, c.body)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v, want ok %v", c.name, err, c.ok)
+			continue
+		}
+		if err == nil && string(body) != "body" && len(body) != 0 {
+			t.Errorf("%s: got body %q", c.name, body)
+		}
+	}
+}
+
+// the sequence number drawn by the caller comes out as it went in
+func TestAuthSequence(t *testing.T)  {
+	key := AuthKey("token")
+	ad := []byte("header")
+
+	for _, seq := range []uint64{1, 7, 1 << 40, ^uint64(0)} {
+		_, got, err := AuthDecoder(key, AuthSeqCoder(key, seq, []byte("body")))
+		if err != nil || got != seq {
+			t.Errorf("json envelope sequence %d got %d, %v", seq, got, err)
+		}
+		_, got, err = AuthOpen(key, ad, AuthSealSeq(key, ad, seq, []byte("body")))
+		if err != nil || got != seq {
+			t.Errorf("binary envelope sequence %d got %d, %v", seq, got, err)
+		}
+	}
+}
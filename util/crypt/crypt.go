@@ -0,0 +1,90 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const KEY_SIZE   = 32
+const NONCE_SIZE = 12
+const TAG_SIZE   = 16
+
+const OVERHEAD = NONCE_SIZE + TAG_SIZE
+
+// HKDF-SHA256 (RFC 5869) limited to a single output block
+func DeriveKey(secret []byte, label string, info ...[]byte) []byte {
+	extract := hmac.New(sha256.New, nil)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(label))
+	for _, v := range info {
+		expand.Write(v)
+	}
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:KEY_SIZE]
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AES-256-GCM session with one key per direction; the nonce is a
+// 64bit counter seeded from the clock, so a restarted node never
+// reuses a nonce under the same key, the receiver checks it against
+// a replay window
+type Session struct {
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	counter uint64
+	replay  *ReplayWindow
+}
+
+func NewSession(sendKey []byte, recvKey []byte) (*Session, error) {
+	var err error
+
+	s := new(Session)
+	s.send, err = newAEAD(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	s.recv, err = newAEAD(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	s.counter = uint64(time.Now().UnixNano())
+	s.replay = NewReplayWindow()
+	return s, nil
+}
+
+func (s *Session)Seal(aad []byte, plain []byte) []byte {
+	output := make([]byte, NONCE_SIZE, NONCE_SIZE + len(plain) + TAG_SIZE)
+	binary.BigEndian.PutUint64(output[4:], atomic.AddUint64(&s.counter, 1))
+	return s.send.Seal(output, output[:NONCE_SIZE], plain, aad)
+}
+
+func (s *Session)Open(aad []byte, body []byte) ([]byte, error) {
+	if len(body) < OVERHEAD {
+		return nil, fmt.Errorf("sealed body length %d too small", len(body))
+	}
+	plain, err := s.recv.Open(nil, body[:NONCE_SIZE], body[NONCE_SIZE:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("sealed body authentication fail, %s", err.Error())
+	}
+	counter := binary.BigEndian.Uint64(body[4:NONCE_SIZE])
+	if s.replay.Check(counter) == false {
+		return nil, &ReplayError{Seq: counter, Drops: s.replay.Drops()}
+	}
+	return plain, nil
+}
@@ -0,0 +1,187 @@
+package crypt
+
+import (
+	"bytes"
+	"github.com/easymesh/easymesh/util/ip"
+	"testing"
+)
+
+func testSessions(t *testing.T) (*Session, *Session) {
+	k1 := DeriveKey([]byte("secret"), "send")
+	k2 := DeriveKey([]byte("secret"), "recv")
+
+	a, err := NewSession(k1, k2)
+	if err != nil {
+		t.Fatalf("session fail, %s", err.Error())
+	}
+	b, err := NewSession(k2, k1)
+	if err != nil {
+		t.Fatalf("session fail, %s", err.Error())
+	}
+	return a, b
+}
+
+func testFrame() *ip.FrameHeader {
+	return &ip.FrameHeader{Type: ip.FRAME_SEALED, TTL: ip.MAX_FRAMETTL,
+		SAddr: ip.MustParseIP4("172.168.0.1"), DAddr: ip.MustParseIP4("172.168.0.2")}
+}
+
+func TestDeriveKey(t *testing.T)  {
+	base := DeriveKey([]byte("secret"), "label")
+
+	cases := []struct {
+		name  string
+		key   []byte
+		equal bool
+	}{
+		{"same input", DeriveKey([]byte("secret"), "label"), true},
+		{"other secret", DeriveKey([]byte("secreT"), "label"), false},
+		{"other label", DeriveKey([]byte("secret"), "label2"), false},
+		{"with info", DeriveKey([]byte("secret"), "label", []byte{1}), false},
+		{"empty secret", DeriveKey(nil, "label"), false},
+	}
+
+	for _, c := range cases {
+		if len(c.key) != KEY_SIZE {
+			t.Errorf("%s: key length %d, want %d", c.name, len(c.key), KEY_SIZE)
+		}
+		if bytes.Equal(c.key, base) != c.equal {
+			t.Errorf("%s: key equal %v, want %v", c.name, !c.equal, c.equal)
+		}
+	}
+}
+
+func TestSessionSealOpen(t *testing.T)  {
+	a, b := testSessions(t)
+	hdr := testFrame()
+
+	cases := []struct {
+		name  string
+		plain []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte{0x45}},
+		{"mtu", bytes.Repeat([]byte{0xaa}, 1400)},
+	}
+
+	for _, c := range cases {
+		for _, dir := range [][2]*Session{{a, b}, {b, a}} {
+			sealed := dir[0].Seal(hdr.AAD(), c.plain)
+			if len(sealed) != len(c.plain) + OVERHEAD {
+				t.Errorf("%s: sealed length %d, want %d", c.name, len(sealed), len(c.plain) + OVERHEAD)
+			}
+			plain, err := dir[1].Open(hdr.AAD(), sealed)
+			if err != nil {
+				t.Errorf("%s: open fail, %s", c.name, err.Error())
+				continue
+			}
+			if bytes.Equal(plain, c.plain) == false {
+				t.Errorf("%s: opened body differs", c.name)
+			}
+		}
+	}
+}
+
+func TestSessionTampered(t *testing.T)  {
+	a, b := testSessions(t)
+
+	cases := []struct {
+		name   string
+		header func(hdr *ip.FrameHeader)
+		body   func(sealed []byte) []byte
+		recv   *Session
+		ok     bool
+	}{
+		// relays decrement the ttl, it is left out of the aad
+		{"ttl decremented", func(hdr *ip.FrameHeader) { hdr.TTL-- }, nil, b, true},
+		{"source swapped", func(hdr *ip.FrameHeader) { hdr.SAddr++ }, nil, b, false},
+		{"destination swapped", func(hdr *ip.FrameHeader) { hdr.DAddr++ }, nil, b, false},
+		{"frame type", func(hdr *ip.FrameHeader) { hdr.Type++ }, nil, b, false},
+		{"nonce flipped", nil, func(sealed []byte) []byte { sealed[NONCE_SIZE - 1] ^= 1; return sealed }, b, false},
+		{"body flipped", nil, func(sealed []byte) []byte { sealed[NONCE_SIZE] ^= 1; return sealed }, b, false},
+		{"tag flipped", nil, func(sealed []byte) []byte { sealed[len(sealed) - 1] ^= 1; return sealed }, b, false},
+		{"tag cut", nil, func(sealed []byte) []byte { return sealed[:len(sealed) - 1] }, b, false},
+		{"below overhead", nil, func(sealed []byte) []byte { return sealed[:OVERHEAD - 1] }, b, false},
+		{"empty", nil, func(sealed []byte) []byte { return nil }, b, false},
+		{"opened by the sender", nil, nil, a, false},
+	}
+
+	for _, c := range cases {
+		hdr := testFrame()
+		sealed := a.Seal(hdr.AAD(), []byte("payload"))
+
+		if c.header != nil {
+			c.header(hdr)
+		}
+		if c.body != nil {
+			sealed = c.body(sealed)
+		}
+
+		_, err := c.recv.Open(hdr.AAD(), sealed)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v, want ok %v", c.name, err, c.ok)
+		}
+	}
+}
+
+// a frame opens after every relay hop until the ttl runs out
+func TestSessionTTL(t *testing.T)  {
+	a, b := testSessions(t)
+	hdr := testFrame()
+
+	hops := 0
+	for {
+		sealed := a.Seal(hdr.AAD(), []byte("payload"))
+		_, err := b.Open(hdr.AAD(), sealed)
+		if err != nil {
+			t.Fatalf("hop %d ttl %d: open fail, %s", hops, hdr.TTL, err.Error())
+		}
+		if hdr.DecrementTTL() != nil {
+			break
+		}
+		hops++
+	}
+	if hops != ip.MAX_FRAMETTL - 1 || hdr.TTL != 1 {
+		t.Errorf("frame dropped after %d hops at ttl %d, want %d hops", hops, hdr.TTL, ip.MAX_FRAMETTL - 1)
+	}
+}
+
+func TestSessionReplay(t *testing.T)  {
+	a, b := testSessions(t)
+	hdr := testFrame()
+
+	var sealed [][]byte
+	for i := 0; i < 3; i++ {
+		sealed = append(sealed, a.Seal(hdr.AAD(), []byte("payload")))
+	}
+
+	// a sender restarted with the same keys counts on from the clock
+	restarted, _ := testSessions(t)
+	later := restarted.Seal(hdr.AAD(), []byte("payload"))
+
+	cases := []struct {
+		name string
+		body []byte
+		ok   bool
+	}{
+		{"second", sealed[1], true},
+		{"first out of order", sealed[0], true},
+		{"first replayed", sealed[0], false},
+		{"second replayed", sealed[1], false},
+		{"third", sealed[2], true},
+		{"restarted sender", later, true},
+		{"third replayed", sealed[2], false},
+	}
+
+	for _, c := range cases {
+		_, err := b.Open(hdr.AAD(), c.body)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v, want ok %v", c.name, err, c.ok)
+		}
+		if err != nil {
+			if _, ok := err.(*ReplayError); ok == false {
+				t.Errorf("%s: got error %T, want *ReplayError", c.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Noise IK style handshake between two nodes whose static keys are
+// published in the route list:
+//
+//   <- s
+//   ...
+//   -> e, es, s, ss, {timestamp}
+//   <- e, ee, se, {}
+//
+// the initiator already knows the responder static key, so the first
+// message authenticates the initiator and the second one the responder
+
+const PROTOCOL_NAME = "easymesh_IK_25519_AESGCM_SHA256"
+
+const HANDSHAKE_INIT_SIZE = PUBKEY_SIZE + PUBKEY_SIZE + TAG_SIZE + 8 + TAG_SIZE
+const HANDSHAKE_RESP_SIZE = PUBKEY_SIZE + TAG_SIZE
+
+type Handshake struct {
+	static     *KeyPair
+	ephemeral  *KeyPair
+
+	peerStatic    []byte
+	peerEphemeral []byte
+	timestamp     uint64
+
+	ck []byte
+	h  []byte
+}
+
+func hash(input ...[]byte) []byte {
+	h := sha256.New()
+	for _, v := range input {
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+// HKDF with the chaining key as salt, returns the next chaining key and
+// a message key
+func kdf2(ck []byte, input []byte) ([]byte, []byte) {
+	extract := hmac.New(sha256.New, ck)
+	extract.Write(input)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte{1})
+	out1 := expand.Sum(nil)
+
+	expand.Reset()
+	expand.Write(out1)
+	expand.Write([]byte{2})
+	out2 := expand.Sum(nil)
+
+	return out1, out2
+}
+
+func newHandshake(static *KeyPair, responderStatic []byte) *Handshake {
+	hs := &Handshake{static: static}
+	hs.ck = hash([]byte(PROTOCOL_NAME))
+	hs.h = hash(hs.ck, responderStatic)
+	return hs
+}
+
+func (hs *Handshake)mixHash(data []byte)  {
+	hs.h = hash(hs.h, data)
+}
+
+func (hs *Handshake)mixKey(local *KeyPair, remote []byte) ([]byte, error) {
+	shared, err := local.DH(remote)
+	if err != nil {
+		return nil, fmt.Errorf("handshake dh fail, %s", err.Error())
+	}
+	var key []byte
+	hs.ck, key = kdf2(hs.ck, shared)
+	return key, nil
+}
+
+func (hs *Handshake)encrypt(key []byte, plain []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	output := aead.Seal(nil, make([]byte, NONCE_SIZE), plain, hs.h)
+	hs.mixHash(output)
+	return output, nil
+}
+
+func (hs *Handshake)decrypt(key []byte, body []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, make([]byte, NONCE_SIZE), body, hs.h)
+	if err != nil {
+		return nil, fmt.Errorf("handshake authentication fail")
+	}
+	hs.mixHash(body)
+	return plain, nil
+}
+
+func (hs *Handshake)split(initiator bool) (*Session, error) {
+	k1, k2 := kdf2(hs.ck, nil)
+	if initiator {
+		return NewSession(k1, k2)
+	}
+	return NewSession(k2, k1)
+}
+
+// start a handshake toward the peer, returns the initiation message
+func NewInitiator(static *KeyPair, peerStatic []byte) (*Handshake, []byte, error) {
+	var err error
+
+	if len(peerStatic) != PUBKEY_SIZE {
+		return nil, nil, fmt.Errorf("peer static key length %d is invalid", len(peerStatic))
+	}
+
+	hs := newHandshake(static, peerStatic)
+	hs.peerStatic = peerStatic
+
+	hs.ephemeral, err = NewKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg := make([]byte, 0, HANDSHAKE_INIT_SIZE)
+
+	epub := hs.ephemeral.PublicKey()
+	hs.mixHash(epub)
+	msg = append(msg, epub...)
+
+	key, err := hs.mixKey(hs.ephemeral, peerStatic)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := hs.encrypt(key, static.PublicKey())
+	if err != nil {
+		return nil, nil, err
+	}
+	msg = append(msg, body...)
+
+	key, err = hs.mixKey(static, peerStatic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(time.Now().UnixNano()))
+	body, err = hs.encrypt(key, timestamp[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	msg = append(msg, body...)
+
+	return hs, msg, nil
+}
+
+// finish the handshake on the initiator side with the responder message
+func (hs *Handshake)ConsumeResponse(msg []byte) (*Session, error) {
+	if len(msg) != HANDSHAKE_RESP_SIZE {
+		return nil, fmt.Errorf("handshake response length %d is invalid", len(msg))
+	}
+
+	hs.peerEphemeral = msg[:PUBKEY_SIZE]
+	hs.mixHash(hs.peerEphemeral)
+
+	_, err := hs.mixKey(hs.ephemeral, hs.peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hs.mixKey(hs.static, hs.peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	_, err = hs.decrypt(key, msg[PUBKEY_SIZE:])
+	if err != nil {
+		return nil, err
+	}
+	return hs.split(true)
+}
+
+// process an initiation message on the responder side, the caller must
+// check PeerStatic and Timestamp before answering with Response
+func ConsumeInit(static *KeyPair, msg []byte) (*Handshake, error) {
+	if len(msg) != HANDSHAKE_INIT_SIZE {
+		return nil, fmt.Errorf("handshake init length %d is invalid", len(msg))
+	}
+
+	hs := newHandshake(static, static.PublicKey())
+
+	hs.peerEphemeral = msg[:PUBKEY_SIZE]
+	hs.mixHash(hs.peerEphemeral)
+	msg = msg[PUBKEY_SIZE:]
+
+	key, err := hs.mixKey(static, hs.peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	hs.peerStatic, err = hs.decrypt(key, msg[:PUBKEY_SIZE + TAG_SIZE])
+	if err != nil {
+		return nil, err
+	}
+	msg = msg[PUBKEY_SIZE + TAG_SIZE:]
+
+	key, err = hs.mixKey(static, hs.peerStatic)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := hs.decrypt(key, msg)
+	if err != nil {
+		return nil, err
+	}
+	hs.timestamp = binary.BigEndian.Uint64(timestamp)
+
+	return hs, nil
+}
+
+func (hs *Handshake)PeerStatic() []byte {
+	return hs.peerStatic
+}
+
+func (hs *Handshake)Timestamp() uint64 {
+	return hs.timestamp
+}
+
+// answer an initiation message, returns the response message and the
+// established session
+func (hs *Handshake)Response() ([]byte, *Session, error) {
+	var err error
+
+	hs.ephemeral, err = NewKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg := make([]byte, 0, HANDSHAKE_RESP_SIZE)
+
+	epub := hs.ephemeral.PublicKey()
+	hs.mixHash(epub)
+	msg = append(msg, epub...)
+
+	_, err = hs.mixKey(hs.ephemeral, hs.peerEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := hs.mixKey(hs.ephemeral, hs.peerStatic)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := hs.encrypt(key, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg = append(msg, body...)
+
+	s, err := hs.split(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, s, nil
+}
@@ -0,0 +1,180 @@
+package crypt
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func testKeyPair(t *testing.T) *KeyPair {
+	kp, err := NewKeyPair()
+	if err != nil {
+		t.Fatalf("key pair fail, %s", err.Error())
+	}
+	return kp
+}
+
+// both ends of a handshake, the sessions are checked to talk to each
+// other both ways
+func testHandshake(t *testing.T, initiator *KeyPair, responder *KeyPair) (*Session, *Session) {
+	hs, init, err := NewInitiator(initiator, responder.PublicKey())
+	if err != nil {
+		t.Fatalf("handshake init fail, %s", err.Error())
+	}
+	if len(init) != HANDSHAKE_INIT_SIZE {
+		t.Fatalf("handshake init length %d, want %d", len(init), HANDSHAKE_INIT_SIZE)
+	}
+
+	rhs, err := ConsumeInit(responder, init)
+	if err != nil {
+		t.Fatalf("handshake init consume fail, %s", err.Error())
+	}
+	resp, rs, err := rhs.Response()
+	if err != nil {
+		t.Fatalf("handshake response fail, %s", err.Error())
+	}
+	if len(resp) != HANDSHAKE_RESP_SIZE {
+		t.Fatalf("handshake response length %d, want %d", len(resp), HANDSHAKE_RESP_SIZE)
+	}
+
+	is, err := hs.ConsumeResponse(resp)
+	if err != nil {
+		t.Fatalf("handshake response consume fail, %s", err.Error())
+	}
+	return is, rs
+}
+
+func TestHandshake(t *testing.T)  {
+	initiator := testKeyPair(t)
+	responder := testKeyPair(t)
+
+	hs, init, err := NewInitiator(initiator, responder.PublicKey())
+	if err != nil {
+		t.Fatalf("handshake init fail, %s", err.Error())
+	}
+	rhs, err := ConsumeInit(responder, init)
+	if err != nil {
+		t.Fatalf("handshake init consume fail, %s", err.Error())
+	}
+
+	// the responder learns who is calling and when
+	if bytes.Equal(rhs.PeerStatic(), initiator.PublicKey()) == false {
+		t.Errorf("responder got peer static key %x, want %x", rhs.PeerStatic(), initiator.PublicKey())
+	}
+	delta := time.Since(time.Unix(0, int64(rhs.Timestamp())))
+	if delta < 0 || delta > time.Minute {
+		t.Errorf("handshake timestamp off by %s", delta.String())
+	}
+
+	resp, rs, err := rhs.Response()
+	if err != nil {
+		t.Fatalf("handshake response fail, %s", err.Error())
+	}
+	is, err := hs.ConsumeResponse(resp)
+	if err != nil {
+		t.Fatalf("handshake response consume fail, %s", err.Error())
+	}
+
+	cases := []struct {
+		name string
+		from *Session
+		to   *Session
+	}{
+		{"initiator to responder", is, rs},
+		{"responder to initiator", rs, is},
+	}
+	for _, c := range cases {
+		plain, err := c.to.Open([]byte("aad"), c.from.Seal([]byte("aad"), []byte("payload")))
+		if err != nil || string(plain) != "payload" {
+			t.Errorf("%s: open fail, %v", c.name, err)
+		}
+	}
+
+	// every handshake comes up with keys of its own
+	is2, _ := testHandshake(t, initiator, responder)
+	_, err = rs.Open([]byte("aad"), is2.Seal([]byte("aad"), []byte("payload")))
+	if err == nil {
+		t.Errorf("session of another handshake opened")
+	}
+}
+
+func TestHandshakeInitRefused(t *testing.T)  {
+	initiator := testKeyPair(t)
+	responder := testKeyPair(t)
+	other := testKeyPair(t)
+
+	cases := []struct {
+		name   string
+		peer   []byte
+		tamper func(msg []byte) []byte
+	}{
+		{"wrong responder static key", other.PublicKey(), nil},
+		{"ephemeral flipped", responder.PublicKey(), func(msg []byte) []byte { msg[0] ^= 1; return msg }},
+		{"static flipped", responder.PublicKey(), func(msg []byte) []byte { msg[PUBKEY_SIZE] ^= 1; return msg }},
+		{"timestamp flipped", responder.PublicKey(), func(msg []byte) []byte { msg[len(msg) - TAG_SIZE - 1] ^= 1; return msg }},
+		{"tag flipped", responder.PublicKey(), func(msg []byte) []byte { msg[len(msg) - 1] ^= 1; return msg }},
+		{"truncated", responder.PublicKey(), func(msg []byte) []byte { return msg[:len(msg) - 1] }},
+		{"too long", responder.PublicKey(), func(msg []byte) []byte { return append(msg, 0) }},
+	}
+
+	for _, c := range cases {
+		_, init, err := NewInitiator(initiator, c.peer)
+		if err != nil {
+			t.Errorf("%s: handshake init fail, %s", c.name, err.Error())
+			continue
+		}
+		if c.tamper != nil {
+			init = c.tamper(init)
+		}
+		_, err = ConsumeInit(responder, init)
+		if err == nil {
+			t.Errorf("%s: init consumed", c.name)
+		}
+	}
+
+	for _, peer := range [][]byte{nil, make([]byte, PUBKEY_SIZE - 1), make([]byte, PUBKEY_SIZE + 1)} {
+		_, _, err := NewInitiator(initiator, peer)
+		if err == nil {
+			t.Errorf("init toward static key of length %d", len(peer))
+		}
+	}
+}
+
+func TestHandshakeResponseRefused(t *testing.T)  {
+	initiator := testKeyPair(t)
+	responder := testKeyPair(t)
+
+	cases := []struct {
+		name   string
+		tamper func(msg []byte, other []byte) []byte
+	}{
+		{"ephemeral flipped", func(msg []byte, other []byte) []byte { msg[0] ^= 1; return msg }},
+		{"tag flipped", func(msg []byte, other []byte) []byte { msg[len(msg) - 1] ^= 1; return msg }},
+		{"truncated", func(msg []byte, other []byte) []byte { return msg[:len(msg) - 1] }},
+		{"response to another init", func(msg []byte, other []byte) []byte { return other }},
+	}
+
+	for _, c := range cases {
+		hs, init, err := NewInitiator(initiator, responder.PublicKey())
+		if err != nil {
+			t.Fatalf("%s: handshake init fail, %s", c.name, err.Error())
+		}
+		rhs, err := ConsumeInit(responder, init)
+		if err != nil {
+			t.Fatalf("%s: handshake init consume fail, %s", c.name, err.Error())
+		}
+		resp, _, err := rhs.Response()
+		if err != nil {
+			t.Fatalf("%s: handshake response fail, %s", c.name, err.Error())
+		}
+
+		_, init2, _ := NewInitiator(initiator, responder.PublicKey())
+		rhs2, _ := ConsumeInit(responder, init2)
+		resp2, _, _ := rhs2.Response()
+
+		_, err = hs.ConsumeResponse(c.tamper(resp, resp2))
+		if err == nil {
+			t.Errorf("%s: response consumed", c.name)
+		}
+	}
+}
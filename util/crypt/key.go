@@ -0,0 +1,104 @@
+package crypt
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const PUBKEY_SIZE = 32
+
+type KeyPair struct {
+	private *ecdh.PrivateKey
+}
+
+func NewKeyPair() (*KeyPair, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{private: private}, nil
+}
+
+// load the static curve25519 key pair of this node, a new one is
+// generated and saved when the file does not exist yet
+func LoadKeyPair(filename string) (*KeyPair, error) {
+	body, err := ioutil.ReadFile(filename)
+	if err == nil {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+		if err != nil {
+			return nil, fmt.Errorf("key file %s decode fail, %s", filename, err.Error())
+		}
+		private, err := ecdh.X25519().NewPrivateKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("key file %s is invalid, %s", filename, err.Error())
+		}
+		return &KeyPair{private: private}, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	kp, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	output := base64.StdEncoding.EncodeToString(kp.private.Bytes())
+	err = ioutil.WriteFile(filename, []byte(output + "\n"), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("key file %s save fail, %s", filename, err.Error())
+	}
+	return kp, nil
+}
+
+func (kp *KeyPair)PublicKey() []byte {
+	return kp.private.PublicKey().Bytes()
+}
+
+func (kp *KeyPair)DH(peer []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	return kp.private.ECDH(pub)
+}
+
+// proof of holding the static key toward the static key of the peer,
+// bound to the claim and to the sequence number of the message carrying
+// it, so it can not be taken over into another message
+func (kp *KeyPair)Proof(peer []byte, label string, seq uint64, claim []byte) ([]byte, error) {
+	secret, err := kp.DH(peer)
+	if err != nil {
+		return nil, err
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint64(header[:], seq)
+
+	mac := hmac.New(sha256.New, DeriveKey(secret, label))
+	mac.Write(header[:])
+	mac.Write(claim)
+	return mac.Sum(nil), nil
+}
+
+func (kp *KeyPair)CheckProof(peer []byte, label string, seq uint64, claim []byte, proof []byte) error {
+	if len(proof) == 0 {
+		return fmt.Errorf("key proof is absent")
+	}
+	expect, err := kp.Proof(peer, label, seq, claim)
+	if err != nil {
+		return fmt.Errorf("key proof fail, %s", err.Error())
+	}
+	if hmac.Equal(expect, proof) == false {
+		return fmt.Errorf("key proof illegal")
+	}
+	return nil
+}
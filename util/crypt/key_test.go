@@ -0,0 +1,134 @@
+package crypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyPairDH(t *testing.T)  {
+	a := testKeyPair(t)
+	b := testKeyPair(t)
+	c := testKeyPair(t)
+
+	ab, err := a.DH(b.PublicKey())
+	if err != nil {
+		t.Fatalf("dh fail, %s", err.Error())
+	}
+
+	cases := []struct {
+		name  string
+		local *KeyPair
+		peer  []byte
+		equal bool
+		ok    bool
+	}{
+		{"other side", b, a.PublicKey(), true, true},
+		{"third key", c, a.PublicKey(), false, true},
+		{"short peer key", a, b.PublicKey()[:PUBKEY_SIZE - 1], false, false},
+		{"empty peer key", a, nil, false, false},
+	}
+
+	for _, c := range cases {
+		shared, err := c.local.DH(c.peer)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v, want ok %v", c.name, err, c.ok)
+			continue
+		}
+		if err == nil && bytes.Equal(shared, ab) != c.equal {
+			t.Errorf("%s: shared secret equal %v, want %v", c.name, !c.equal, c.equal)
+		}
+	}
+}
+
+func TestLoadKeyPair(t *testing.T)  {
+	dir, err := ioutil.TempDir("", "easymesh")
+	if err != nil {
+		t.Fatalf("temp dir fail, %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// generated and saved on first use, loaded afterwards
+	filename := filepath.Join(dir, "node.key")
+	first, err := LoadKeyPair(filename)
+	if err != nil {
+		t.Fatalf("key generate fail, %s", err.Error())
+	}
+	info, err := os.Stat(filename)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file not saved private, %v", err)
+	}
+	second, err := LoadKeyPair(filename)
+	if err != nil {
+		t.Fatalf("key load fail, %s", err.Error())
+	}
+	if bytes.Equal(first.PublicKey(), second.PublicKey()) == false {
+		t.Errorf("loaded key differs from the saved one")
+	}
+
+	cases := []struct {
+		name string
+		body string
+	}{
+		{"not base64", "not a key\n"},
+		{"short key", "AAAA\n"},
+	}
+
+	for _, c := range cases {
+		filename := filepath.Join(dir, c.name)
+		err := ioutil.WriteFile(filename, []byte(c.body), 0600)
+		if err != nil {
+			t.Fatalf("%s: write fail, %s", c.name, err.Error())
+		}
+		_, err = LoadKeyPair(filename)
+		if err == nil {
+			t.Errorf("%s: key loaded", c.name)
+		}
+	}
+}
+
+func TestKeyProof(t *testing.T)  {
+	gateway := testKeyPair(t)
+	transfer := testKeyPair(t)
+	other := testKeyPair(t)
+
+	claim := []byte("claim")
+	proof, err := gateway.Proof(transfer.PublicKey(), "register", 7, claim)
+	if err != nil {
+		t.Fatalf("proof fail, %s", err.Error())
+	}
+
+	cases := []struct {
+		name  string
+		peer  []byte
+		label string
+		seq   uint64
+		claim []byte
+		proof []byte
+		ok    bool
+	}{
+		{"proven", gateway.PublicKey(), "register", 7, claim, proof, true},
+		{"other key claimed", other.PublicKey(), "register", 7, claim, proof, false},
+		{"other label", gateway.PublicKey(), "leave", 7, claim, proof, false},
+		{"other sequence", gateway.PublicKey(), "register", 8, claim, proof, false},
+		{"other claim", gateway.PublicKey(), "register", 7, []byte("claiM"), proof, false},
+		{"truncated", gateway.PublicKey(), "register", 7, claim, proof[:len(proof) - 1], false},
+		{"absent", gateway.PublicKey(), "register", 7, claim, nil, false},
+		{"illegal peer key", gateway.PublicKey()[:PUBKEY_SIZE - 1], "register", 7, claim, proof, false},
+	}
+
+	for _, c := range cases {
+		err := transfer.CheckProof(c.peer, c.label, c.seq, c.claim, c.proof)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v, want ok %v", c.name, err, c.ok)
+		}
+	}
+
+	// a proof toward another transfer is no proof toward this one
+	proof, _ = gateway.Proof(other.PublicKey(), "register", 7, claim)
+	if transfer.CheckProof(gateway.PublicKey(), "register", 7, claim, proof) == nil {
+		t.Errorf("proof toward another key accepted")
+	}
+}
@@ -0,0 +1,158 @@
+package crypt
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const REPLAY_WINDOW = 1024
+
+// sliding window over monotonically increasing sequence numbers, see
+// RFC 6479; a number is accepted once as long as it is not older than
+// the window
+type ReplayWindow struct {
+	sync.Mutex
+	top    uint64
+	bitmap [REPLAY_WINDOW / 64]uint64
+	drops  uint64
+}
+
+func NewReplayWindow() *ReplayWindow {
+	return new(ReplayWindow)
+}
+
+func (w *ReplayWindow)setBit(seq uint64, value bool)  {
+	idx := (seq % REPLAY_WINDOW) / 64
+	bit := uint64(1) << (seq % 64)
+	if value {
+		w.bitmap[idx] |= bit
+	} else {
+		w.bitmap[idx] &^= bit
+	}
+}
+
+func (w *ReplayWindow)getBit(seq uint64) bool {
+	return w.bitmap[(seq % REPLAY_WINDOW) / 64] & (uint64(1) << (seq % 64)) != 0
+}
+
+func (w *ReplayWindow)Check(seq uint64) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if seq == 0 {
+		w.drops++
+		return false
+	}
+
+	if seq > w.top {
+		if seq - w.top >= REPLAY_WINDOW {
+			w.bitmap = [REPLAY_WINDOW / 64]uint64{}
+		} else {
+			for i := w.top + 1; i < seq; i++ {
+				w.setBit(i, false)
+			}
+		}
+		w.top = seq
+		w.setBit(seq, true)
+		return true
+	}
+
+	if w.top - seq >= REPLAY_WINDOW || w.getBit(seq) {
+		w.drops++
+		return false
+	}
+
+	w.setBit(seq, true)
+	return true
+}
+
+func (w *ReplayWindow)Drops() uint64 {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.drops
+}
+
+type ReplayError struct {
+	Seq   uint64
+	Drops uint64
+}
+
+func (e *ReplayError)Error() string {
+	return fmt.Sprintf("replayed sequence %d, %d replays dropped", e.Seq, e.Drops)
+}
+
+var sequence = uint64(time.Now().UnixNano())
+
+// process wide sequence number, seeded from the clock so that it keeps
+// growing across restarts
+func NextSequence() uint64 {
+	return atomic.AddUint64(&sequence, 1)
+}
+
+// replay windows of many senders, keyed by their identity; a window
+// idle longer than REPLAY_IDLE is dropped, whatever it refused is out of
+// the auth window by then, new senders are refused while the table is
+// full
+const (
+	REPLAY_IDLE      = 2 * AUTH_WINDOW
+	REPLAY_TABLE_MAX = 65536
+)
+
+type replayEntry struct {
+	window *ReplayWindow
+	seen   time.Time
+}
+
+type ReplayTable struct {
+	sync.Mutex
+	list   map[interface{}]*replayEntry
+	pruned time.Time
+}
+
+func NewReplayTable() *ReplayTable {
+	return &ReplayTable{list: make(map[interface{}]*replayEntry, 1024), pruned: time.Now()}
+}
+
+func (t *ReplayTable)prune(now time.Time)  {
+	for key, e := range t.list {
+		if now.Sub(e.seen) > REPLAY_IDLE {
+			delete(t.list, key)
+		}
+	}
+	t.pruned = now
+}
+
+func (t *ReplayTable)Check(key interface{}, seq uint64) error {
+	now := time.Now()
+
+	t.Lock()
+	if now.Sub(t.pruned) > REPLAY_IDLE {
+		t.prune(now)
+	}
+	e, _ := t.list[key]
+	if e == nil {
+		if len(t.list) >= REPLAY_TABLE_MAX {
+			t.Unlock()
+			return fmt.Errorf("replay table full, %d senders", REPLAY_TABLE_MAX)
+		}
+		e = &replayEntry{window: NewReplayWindow()}
+		t.list[key] = e
+	}
+	e.seen = now
+	t.Unlock()
+
+	if e.window.Check(seq) == false {
+		return &ReplayError{Seq: seq, Drops: e.window.Drops()}
+	}
+	return nil
+}
+
+func (t *ReplayTable)Len() int {
+	t.Lock()
+	defer t.Unlock()
+
+	return len(t.list)
+}
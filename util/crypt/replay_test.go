@@ -0,0 +1,136 @@
+package crypt
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+type replayStep struct {
+	seq  uint64
+	want bool
+}
+
+func TestReplayWindow(t *testing.T)  {
+	cases := []struct {
+		name  string
+		steps []replayStep
+	}{
+		{"zero is never accepted", []replayStep{{0, false}, {1, true}, {0, false}}},
+		{"duplicate", []replayStep{{1, true}, {1, false}, {2, true}, {1, false}}},
+		{"out of order once", []replayStep{{5, true}, {3, true}, {4, true}, {3, false}, {4, false}}},
+		{"oldest in window", []replayStep{{1024, true}, {1, true}, {1025, true}, {1, false}, {2, true}}},
+		{"older than window", []replayStep{{1025, true}, {1, false}, {2, true}}},
+		// the bitmap slots are reused every REPLAY_WINDOW numbers
+		{"slot reused in window", []replayStep{{100, true}, {1123, true}, {100, false}, {99, false}, {1124, true}, {100, false}, {1124, false}}},
+		{"slots cleared on advance", []replayStep{{10, true}, {11, true}, {1033, true}, {1034, true}, {1035, true}, {1032, true}, {11, false}}},
+		{"gap cleared slots", []replayStep{{1, true}, {2, true}, {1025, true}, {1026, true}, {3, true}, {3, false}}},
+		{"gap clears stale slots", []replayStep{{3, true}, {5, true}, {1028, true}, {1027, true}, {1027, false}, {1029, true}}},
+		{"jump over window", []replayStep{{1, true}, {2, true}, {3, true}, {3000, true}, {2000, true}, {1977, true}, {1976, false}, {3, false}}},
+		{"jump of exactly window", []replayStep{{7, true}, {7 + REPLAY_WINDOW, true}, {7, false}, {8, true}, {8, false}}},
+		{"top of sequence space", []replayStep{{math.MaxUint64 - 1, true}, {math.MaxUint64, true}, {math.MaxUint64, false},
+			{math.MaxUint64 - REPLAY_WINDOW, false}, {math.MaxUint64 - REPLAY_WINDOW + 1, true}}},
+	}
+
+	for _, c := range cases {
+		w := NewReplayWindow()
+		var drops uint64
+		for i, step := range c.steps {
+			got := w.Check(step.seq)
+			if got != step.want {
+				t.Errorf("%s: step %d sequence %d got %v, want %v", c.name, i, step.seq, got, step.want)
+			}
+			if step.want == false {
+				drops++
+			}
+		}
+		if w.Drops() != drops {
+			t.Errorf("%s: drops %d, want %d", c.name, w.Drops(), drops)
+		}
+	}
+}
+
+func TestReplayTable(t *testing.T)  {
+	table := NewReplayTable()
+
+	cases := []struct {
+		key  string
+		seq  uint64
+		want bool
+	}{
+		{"a", 10, true},
+		{"b", 10, true},
+		{"a", 10, false},
+		{"b", 9, true},
+		{"b", 10, false},
+		{"a", 9, true},
+	}
+
+	for i, c := range cases {
+		err := table.Check(c.key, c.seq)
+		if (err == nil) != c.want {
+			t.Errorf("step %d key %s sequence %d got %v, want accepted %v", i, c.key, c.seq, err, c.want)
+		}
+		if err != nil {
+			if _, ok := err.(*ReplayError); ok == false {
+				t.Errorf("step %d got error %T, want *ReplayError", i, err)
+			}
+		}
+	}
+}
+
+func TestReplayTablePrune(t *testing.T)  {
+	table := NewReplayTable()
+	for i := 0; i < 10; i++ {
+		if err := table.Check(i, 5); err != nil {
+			t.Fatalf("key %d got %v", i, err)
+		}
+	}
+
+	// half of the senders went quiet before the last sweep
+	old := time.Now().Add(-REPLAY_IDLE - time.Second)
+	table.Lock()
+	for i := 0; i < 5; i++ {
+		table.list[i].seen = old
+	}
+	table.pruned = old
+	table.Unlock()
+
+	if err := table.Check(10, 5); err != nil {
+		t.Fatalf("key 10 got %v", err)
+	}
+	if table.Len() != 6 {
+		t.Errorf("table length %d after prune, want 6", table.Len())
+	}
+
+	// a dropped window starts over, a kept one still refuses
+	if err := table.Check(0, 5); err != nil {
+		t.Errorf("pruned key got %v, want accepted", err)
+	}
+	if _, ok := table.Check(9, 5).(*ReplayError); ok == false {
+		t.Errorf("kept key accepted a replay")
+	}
+}
+
+func TestReplayTableFull(t *testing.T)  {
+	table := NewReplayTable()
+	for i := 0; i < REPLAY_TABLE_MAX; i++ {
+		if err := table.Check(i, 1); err != nil {
+			t.Fatalf("key %d got %v", i, err)
+		}
+	}
+
+	err := table.Check(REPLAY_TABLE_MAX, 1)
+	if err == nil {
+		t.Fatalf("new key accepted with a full table")
+	}
+	if _, ok := err.(*ReplayError); ok {
+		t.Errorf("full table reported as replay, %v", err)
+	}
+	if err := table.Check(0, 2); err != nil {
+		t.Errorf("known key got %v with a full table", err)
+	}
+	if table.Len() != REPLAY_TABLE_MAX {
+		t.Errorf("table length %d, want %d", table.Len(), REPLAY_TABLE_MAX)
+	}
+}
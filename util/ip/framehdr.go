@@ -0,0 +1,72 @@
+package ip
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+const MAX_FRAMEHEADER = 10
+const MAX_FRAMETTL    = 16
+
+// frame types, the high nibble of the first byte, see IPHeaderType
+const (
+	FRAME_SEALED    = 2
+	FRAME_HANDSHAKE = 3
+)
+
+// mesh frame header, carried in clear in front of every sealed packet so
+// that transfer and relay nodes can route it without the session keys
+type FrameHeader struct {
+	Type  uint8
+	TTL   uint8
+	SAddr IP4
+	DAddr IP4
+}
+
+func FrameHeaderDecoder(buff []byte) *FrameHeader {
+	if len(buff) < MAX_FRAMEHEADER {
+		return nil
+	}
+	hdr := new(FrameHeader)
+	return hdr.Decoder(buff)
+}
+
+func (hdr *FrameHeader)Decoder(buff []byte) *FrameHeader {
+	hdr.Type  = buff[0] >> 4
+	hdr.TTL   = buff[1]
+	hdr.SAddr = IP4(binary.BigEndian.Uint32(buff[2:]))
+	hdr.DAddr = IP4(binary.BigEndian.Uint32(buff[6:]))
+	return hdr
+}
+
+func (hdr *FrameHeader)Coder(buff []byte)  {
+	buff[0] = hdr.Type << 4
+	buff[1] = hdr.TTL
+	binary.BigEndian.PutUint32(buff[2:], uint32(hdr.SAddr))
+	binary.BigEndian.PutUint32(buff[6:], uint32(hdr.DAddr))
+}
+
+// additional authenticated data of the frame, the ttl is left out
+// because relay nodes decrement it on the way
+func (hdr *FrameHeader)AAD() []byte {
+	buff := make([]byte, MAX_FRAMEHEADER)
+	cp := *hdr
+	cp.TTL = 0
+	cp.Coder(buff)
+	return buff
+}
+
+func (hdr *FrameHeader)DecrementTTL() error {
+	if hdr.TTL <= 1 {
+		return fmt.Errorf("Discarding frame %s -> %s due to zero TTL",
+			hdr.SAddr, hdr.DAddr)
+	}
+	hdr.TTL--
+	return nil
+}
+
+func (hdr *FrameHeader)String() string {
+	output, _ :=json.Marshal(hdr)
+	return string(output)
+}
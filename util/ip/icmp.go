@@ -3,6 +3,7 @@ package ip
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
 )
 
 const MAX_IPOPTLEN   = 40
@@ -13,6 +14,13 @@ const IPVERSION = 4
 const ICMP_DEST_UNREACH = 3
 const ICMP_NET_UNREACH  = 0
 
+const ICMP6_DEST_UNREACH = 1
+const ICMP6_NOROUTE      = 0
+const ICMP6_INFOMSG_MASK = 0x80
+
+// an ICMPv6 error must fit into the minimum IPv6 MTU
+const IPV6_MIN_MTU = 1280
+
 type ICMPHeader struct {
 	Type     uint8
 	Code     uint8
@@ -87,3 +95,70 @@ func ICMPUnreachable(saddr IP4, off_iph *IP4Header, offender []byte) ([]byte, er
 	return pkt.Coder(offender[:off_iph_len + 8]), nil
 }
 
+
+// RFC 4443 checksum over the IPv6 pseudo header and the ICMPv6 message
+func icmp6CheckSum(saddr IP6, daddr IP6, msg []byte) uint16 {
+	var sum uint32
+	add := func(body []byte) {
+		for i := 0; i + 1 < len(body); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(body[i:]))
+		}
+		if len(body) % 2 == 1 {
+			sum += uint32(body[len(body) - 1]) << 8
+		}
+	}
+
+	var pseudo [8]byte
+	binary.BigEndian.PutUint32(pseudo[0:], uint32(len(msg)))
+	pseudo[7] = IPPROTO_ICMPV6
+
+	add(saddr)
+	add(daddr)
+	add(pseudo[:])
+	add(msg)
+
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func ICMP6Unreachable(saddr IP6, off_iph *IP6Header, offender []byte) ([]byte, error) {
+	if len(offender) < MAX_IP6HEADER {
+		return nil, fmt.Errorf("not sending no route: mulformed ipv6 pkt: len %d\n", len(offender))
+	}
+
+	if off_iph.NextHdr == IPPROTO_ICMPV6 && len(offender) > MAX_IP6HEADER &&
+		offender[MAX_IP6HEADER] & ICMP6_INFOMSG_MASK == 0 {
+		return nil, fmt.Errorf("RFC 4443 forbids to send ICMPv6 errors about ICMPv6 errors")
+	}
+
+	if net.IP(off_iph.SAddr).IsUnspecified() || net.IP(off_iph.SAddr).IsMulticast() {
+		return nil, fmt.Errorf("not sending ICMPv6 to source %s", off_iph.SAddr.String())
+	}
+
+	quote := len(offender)
+	if quote > IPV6_MIN_MTU - MAX_IP6HEADER - MAX_ICMPHEADER {
+		quote = IPV6_MIN_MTU - MAX_IP6HEADER - MAX_ICMPHEADER
+	}
+
+	body := make([]byte, MAX_IP6HEADER + MAX_ICMPHEADER + quote)
+
+	iph := IP6Header{
+		Version:  6,
+		PlayLoad: uint16(MAX_ICMPHEADER + quote),
+		NextHdr:  IPPROTO_ICMPV6,
+		HopLimit: 64,
+		SAddr:    saddr,
+		DAddr:    off_iph.SAddr,
+	}
+	iph.Coder(body)
+
+	msg := body[MAX_IP6HEADER:]
+	msg[0] = ICMP6_DEST_UNREACH
+	msg[1] = ICMP6_NOROUTE
+	copy(msg[MAX_ICMPHEADER:], offender[:quote])
+	binary.BigEndian.PutUint16(msg[2:], icmp6CheckSum(iph.SAddr, iph.DAddr, msg))
+
+	return body, nil
+}
@@ -3,7 +3,6 @@ package ip
 import (
 	"fmt"
 	"net"
-	"strings"
 )
 
 func InterfaceByName(ifname string) (*net.Interface, error) {
@@ -44,7 +43,7 @@ func InterfaceByAddr(addr string) (*net.Interface, error) {
 		}
 	}
 
-	return nil, fmt.Errorf("failed to find interface by address", addr)
+	return nil, fmt.Errorf("failed to find interface by address %s", addr)
 }
 
 func InterfaceAddsGet(iface *net.Interface) ([]net.IP, error) {
@@ -66,13 +65,15 @@ func InterfaceAddsGet(iface *net.Interface) ([]net.IP, error) {
 }
 
 func IsIPString(ip string) bool {
-	_, err := ParseIP4(ip)
-	if err != nil {
-		return false
-	}
-	return true
+	return net.ParseIP(ip) != nil
 }
 
 func IsIPv4(ip net.IP) bool {
-	return strings.Index(ip.String(), ".") != -1
+	return ip.To4() != nil
+}
+
+// global unicast ipv6 address, usable as underlay candidate without a
+// zone; unique local addresses count as well
+func IsIPv6Global(ip net.IP) bool {
+	return ip.To4() == nil && ip.IsGlobalUnicast()
 }
@@ -53,16 +53,20 @@ func (ip IP6) MarshalJSON() ([]byte, error) {
 }
 
 // UnmarshalJSON: json.Unmarshaler impl
-func (ip IP6) UnmarshalJSON(j []byte) error {
+func (ip *IP6) UnmarshalJSON(j []byte) error {
 	j = bytes.Trim(j, "\"")
 	if val, err := ParseIP6(string(j)); err != nil {
 		return err
 	} else {
-		ip = []byte(val)
+		*ip = IP6(val)
 		return nil
 	}
 }
 
+func (ip IP6) Equal(other IP6) bool {
+	return net.IP(ip).Equal(net.IP(other))
+}
+
 func ParseIP6(s string) (net.IP, error) {
 	ip := net.ParseIP(s)
 	if ip == nil {
@@ -73,7 +77,7 @@ func ParseIP6(s string) (net.IP, error) {
 
 func ParseIP4(s string) (IP4, error) {
 	ip := net.ParseIP(s)
-	if ip == nil {
+	if ip == nil || ip.To4() == nil {
 		return IP4(0), errors.New("Invalid IP address format")
 	}
 	return FromIP(ip), nil
@@ -15,6 +15,8 @@ const (
 	IPPROTO_TCP  = 6
 	IPPROTO_UDP  = 17
 
+	IPPROTO_ICMPV6 = 58
+
 	IPPROTO_RAW  = 255
 )
 
@@ -60,16 +62,23 @@ const (
 	IPv4
 	IPv6
 	IPCtrl
+	Sealed
+	Handshake
+	IPMsg
+	IPUnknown
 )
 
 func IPHeaderType(buff byte) IPType {
 	switch (buff >> 4) {
 	case 0:return IPCtrl
 	case 1:return Ping
+	case 2:return Sealed
+	case 3:return Handshake
 	case 4:return IPv4
+	case 5:return IPMsg
 	case 6:return IPv6
 	default:
-		return IPCtrl
+		return IPUnknown
 	}
 }
 
@@ -135,6 +144,15 @@ func (iphdr *IP6Header)Coder(buff []byte)  {
 	copy(buff[24:40], iphdr.DAddr)
 }
 
+func (iphdr *IP6Header)DecrementHopLimit() error {
+	if iphdr.HopLimit <= 1 {
+		return fmt.Errorf("Discarding IPv6 packet %s -> %s due to zero hop limit\n",
+			iphdr.SAddr, iphdr.DAddr)
+	}
+	iphdr.HopLimit = iphdr.HopLimit - 1
+	return nil
+}
+
 func (iphdr *IP6Header)String() string {
 	output, _ :=json.Marshal(iphdr)
 	return string(output)
@@ -20,6 +20,17 @@ func NewIP4Net(addr string, len uint) (*IP4Net, error) {
 	return &IP4Net{IP: ipnet, PrefixLen: len}, nil
 }
 
+func ParseIP4Net(s string) (IP4Net, error) {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return IP4Net{}, err
+	}
+	if ipnet.IP.To4() == nil {
+		return IP4Net{}, fmt.Errorf("%s is not an ipv4 network", s)
+	}
+	return FromIPNet(ipnet), nil
+}
+
 func (n IP4Net) String() string {
 	return fmt.Sprintf("%s/%d", n.IP.String(), n.PrefixLen)
 }
@@ -0,0 +1,94 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// frames on a stream carry a two byte big endian length prefix, each
+// frame is one datagram of the transport
+const (
+	FRAME_HEADER = 2
+	MAX_FRAME    = 65535
+)
+
+// a connection carrying whole frames, a byte stream with length
+// prefixes or websocket messages
+type FrameConn interface {
+	ReadFrame(buff []byte) (int, error)
+	WriteFrame(body []byte) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+type streamConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewStreamConn(conn net.Conn) FrameConn {
+	return &streamConn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (s *streamConn)WriteFrame(body []byte) error {
+	if len(body) > MAX_FRAME {
+		return fmt.Errorf("stream frame length %d too large", len(body))
+	}
+	output := make([]byte, FRAME_HEADER + len(body))
+	binary.BigEndian.PutUint16(output, uint16(len(body)))
+	copy(output[FRAME_HEADER:], body)
+
+	_, err := s.conn.Write(output)
+	if err != nil {
+		return fmt.Errorf("stream write fail, %s", err.Error())
+	}
+	return nil
+}
+
+func (s *streamConn)ReadFrame(buff []byte) (int, error) {
+	var header [FRAME_HEADER]byte
+	_, err := io.ReadFull(s.reader, header[:])
+	if err != nil {
+		return 0, err
+	}
+	length := int(binary.BigEndian.Uint16(header[:]))
+	if length > len(buff) {
+		return 0, fmt.Errorf("stream frame length %d too large", length)
+	}
+	_, err = io.ReadFull(s.reader, buff[:length])
+	if err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+func (s *streamConn)RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *streamConn)Close() error {
+	return s.conn.Close()
+}
+
+// the first frame a gateway sends names the namespace, the udp port of
+// the transfer instance it belongs to
+func WriteHello(fc FrameConn, port int) error {
+	var body [2]byte
+	binary.BigEndian.PutUint16(body[:], uint16(port))
+	return fc.WriteFrame(body[:])
+}
+
+func ReadHello(fc FrameConn) (int, error) {
+	var body [2]byte
+	cnt, err := fc.ReadFrame(body[:])
+	if err != nil {
+		return 0, err
+	}
+	if cnt != len(body) {
+		return 0, fmt.Errorf("stream hello length %d illegal", cnt)
+	}
+	return int(binary.BigEndian.Uint16(body[:])), nil
+}
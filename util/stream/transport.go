@@ -0,0 +1,219 @@
+package stream
+
+import (
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/easymesh/easymesh/util/udp"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// frames read ahead of a stream transport, a slow reader stalls the
+// stream instead of losing frames
+const STREAM_QUEUE = 256
+
+var streamID uint64
+
+// the address of a stream, one of its own for every connection, so two
+// streams from behind the same proxy are never taken for one another
+type Addr struct {
+	id     uint64
+	remote net.Addr
+}
+
+func (a *Addr)Network() string {
+	return "stream"
+}
+
+func (a *Addr)String() string {
+	return fmt.Sprintf("stream#%d/%s", a.id, a.remote.String())
+}
+
+// the far end of the connection, a proxy for websockets through one
+func (a *Addr)Remote() net.Addr {
+	return a.remote
+}
+
+// the datagram transport over one stream, every frame is a datagram from
+// the address of the stream; the frames are read ahead by a task of its
+// own, so a read may time out without breaking the framing. Datagrams
+// to other addresses go by the mux the stream is attached to
+type Transport struct {
+	conn FrameConn
+	addr *Addr
+	mux  *Mux
+
+	recv     chan []byte
+	deadline atomic.Value
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newTransport(conn FrameConn, mux *Mux) *Transport {
+	s := &Transport{conn: conn, mux: mux, recv: make(chan []byte, STREAM_QUEUE), done: make(chan struct{})}
+	s.addr = &Addr{id: atomic.AddUint64(&streamID, 1), remote: conn.RemoteAddr()}
+	s.deadline.Store(time.Time{})
+
+	go s.readTask()
+	return s
+}
+
+func (s *Transport)readTask()  {
+	defer s.Close()
+
+	for {
+		buff := make([]byte, MAX_FRAME)
+		cnt, err := s.conn.ReadFrame(buff)
+		if err != nil {
+			logs.Info("stream %s closed, %s", s.addr.String(), err.Error())
+			return
+		}
+
+		select {
+		case s.recv <- buff[:cnt]:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Transport)Addr() *Addr {
+	return s.addr
+}
+
+func (s *Transport)Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Transport)WriteTo(body []byte, dstAddr net.Addr) error {
+	if dstAddr != nil && dstAddr.String() != s.addr.String() {
+		if s.mux == nil {
+			return fmt.Errorf("stream %s can not send to %s", s.addr.String(), dstAddr.String())
+		}
+		return s.mux.WriteTo(body, dstAddr)
+	}
+	return s.conn.WriteFrame(body)
+}
+
+// returns net.ErrClosed once the stream is gone, the receive tasks end
+// by it
+func (s *Transport)ReadFrom(buff []byte) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+
+	deadline := s.deadline.Load().(time.Time)
+	if deadline.IsZero() == false {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case frame := <-s.recv:
+		if len(frame) > len(buff) {
+			return 0, s.addr, fmt.Errorf("stream frame length %d too large", len(frame))
+		}
+		return copy(buff, frame), s.addr, nil
+	case <-s.done:
+		return 0, s.addr, net.ErrClosed
+	case <-timeout:
+		return 0, s.addr, os.ErrDeadlineExceeded
+	}
+}
+
+func (s *Transport)SetReadDeadline(t time.Time) error {
+	s.deadline.Store(t)
+	return nil
+}
+
+func (s *Transport)Close() error {
+	s.once.Do(func() {
+		s.conn.Close()
+		close(s.done)
+		if s.mux != nil {
+			s.mux.detach(s)
+		}
+	})
+	return nil
+}
+
+// streams carry no udp address of their own
+func (s *Transport)LocalAddrs() []*net.UDPAddr {
+	return nil
+}
+
+// a udp socket and the streams attached to it as one transport; reads
+// come from the socket, every stream is read by its own transport,
+// writes go to the socket or to the stream the address names
+type Mux struct {
+	udp udp.Transport
+
+	sync.RWMutex
+	streams map[uint64]*Transport
+}
+
+func NewMux(conn udp.Transport) *Mux {
+	return &Mux{udp: conn, streams: make(map[uint64]*Transport, 64)}
+}
+
+func (m *Mux)Attach(conn FrameConn) *Transport {
+	s := newTransport(conn, m)
+
+	m.Lock()
+	m.streams[s.addr.id] = s
+	m.Unlock()
+
+	return s
+}
+
+func (m *Mux)detach(s *Transport)  {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.streams, s.addr.id)
+}
+
+func (m *Mux)WriteTo(body []byte, dstAddr net.Addr) error {
+	addr, ok := dstAddr.(*Addr)
+	if ok == false {
+		return m.udp.WriteTo(body, dstAddr)
+	}
+
+	m.RLock()
+	s, _ := m.streams[addr.id]
+	m.RUnlock()
+
+	if s == nil {
+		return fmt.Errorf("stream %s is gone", addr.String())
+	}
+	return s.conn.WriteFrame(body)
+}
+
+func (m *Mux)ReadFrom(buff []byte) (int, net.Addr, error) {
+	return m.udp.ReadFrom(buff)
+}
+
+func (m *Mux)SetReadDeadline(t time.Time) error {
+	return m.udp.SetReadDeadline(t)
+}
+
+func (m *Mux)Close() error {
+	m.RLock()
+	list := make([]*Transport, 0, len(m.streams))
+	for _, s := range m.streams {
+		list = append(list, s)
+	}
+	m.RUnlock()
+
+	for _, s := range list {
+		s.Close()
+	}
+	return m.udp.Close()
+}
+
+func (m *Mux)LocalAddrs() []*net.UDPAddr {
+	return m.udp.LocalAddrs()
+}
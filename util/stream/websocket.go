@@ -0,0 +1,387 @@
+package stream
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minimal RFC 6455 websocket, binary messages only; every message
+// carries exactly one frame of the udp transport
+const (
+	WS_CONTINUATION = 0x0
+	WS_TEXT         = 0x1
+	WS_BINARY       = 0x2
+	WS_CLOSE        = 0x8
+	WS_PING         = 0x9
+	WS_PONG         = 0xA
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const WS_DIAL_TIMEOUT = 10 * time.Second
+
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool
+
+	sync.Mutex
+}
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (ws *wsConn)writeMessage(opcode byte, body []byte) error {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+
+	length := len(body)
+	switch {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = append(header, byte(length >> 8), byte(length))
+	default:
+		header[1] = 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(length))
+		header = append(header, ext[:]...)
+	}
+
+	payload := body
+	if ws.client {
+		// frames from the client are masked
+		var mask [4]byte
+		_, err := rand.Read(mask[:])
+		if err != nil {
+			return err
+		}
+		header[1] |= 0x80
+		header = append(header, mask[:]...)
+
+		payload = make([]byte, length)
+		for i := range body {
+			payload[i] = body[i] ^ mask[i % 4]
+		}
+	}
+
+	ws.Lock()
+	defer ws.Unlock()
+
+	_, err := ws.conn.Write(append(header, payload...))
+	if err != nil {
+		return fmt.Errorf("websocket write fail, %s", err.Error())
+	}
+	return nil
+}
+
+func (ws *wsConn)WriteFrame(body []byte) error {
+	if len(body) > MAX_FRAME {
+		return fmt.Errorf("websocket frame length %d too large", len(body))
+	}
+	return ws.writeMessage(WS_BINARY, body)
+}
+
+// reads the next data message into buff, control frames are handled on
+// the way
+func (ws *wsConn)ReadFrame(buff []byte) (int, error) {
+	var total int
+	for {
+		var header [2]byte
+		_, err := io.ReadFull(ws.reader, header[:])
+		if err != nil {
+			return 0, err
+		}
+
+		fin := header[0] & 0x80 != 0
+		opcode := header[0] & 0x0f
+		masked := header[1] & 0x80 != 0
+
+		if masked == ws.client {
+			return 0, fmt.Errorf("websocket frame masking illegal")
+		}
+
+		length := uint64(header[1] & 0x7f)
+		if length == 126 {
+			var ext [2]byte
+			_, err = io.ReadFull(ws.reader, ext[:])
+			if err != nil {
+				return 0, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		} else if length == 127 {
+			var ext [8]byte
+			_, err = io.ReadFull(ws.reader, ext[:])
+			if err != nil {
+				return 0, err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+
+		var mask [4]byte
+		if masked {
+			_, err = io.ReadFull(ws.reader, mask[:])
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if opcode >= WS_CLOSE {
+			if length > 125 {
+				return 0, fmt.Errorf("websocket control frame length %d illegal", length)
+			}
+			payload := make([]byte, length)
+			_, err = io.ReadFull(ws.reader, payload)
+			if err != nil {
+				return 0, err
+			}
+			if masked {
+				for i := range payload {
+					payload[i] ^= mask[i % 4]
+				}
+			}
+
+			switch opcode {
+			case WS_PING:
+				err = ws.writeMessage(WS_PONG, payload)
+				if err != nil {
+					return 0, err
+				}
+			case WS_CLOSE:
+				ws.writeMessage(WS_CLOSE, nil)
+				return 0, io.EOF
+			}
+			continue
+		}
+
+		if uint64(total) + length > uint64(len(buff)) {
+			return 0, fmt.Errorf("websocket message length %d too large", uint64(total) + length)
+		}
+
+		payload := buff[total:total + int(length)]
+		_, err = io.ReadFull(ws.reader, payload)
+		if err != nil {
+			return 0, err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i % 4]
+			}
+		}
+		total += int(length)
+
+		if fin {
+			return total, nil
+		}
+	}
+}
+
+func (ws *wsConn)RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+func (ws *wsConn)Close() error {
+	return ws.conn.Close()
+}
+
+func headerContains(h http.Header, name string, value string) bool {
+	for _, v := range strings.Split(h.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// http handler upgrading requests to websocket, accept owns the
+// connection afterwards
+func WebSocketHandler(accept func(fc FrameConn)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("Sec-WebSocket-Key")
+		if req.Method != http.MethodGet || key == "" ||
+			headerContains(req.Header, "Connection", "upgrade") == false ||
+			headerContains(req.Header, "Upgrade", "websocket") == false {
+			http.Error(w, "websocket only", http.StatusBadRequest)
+			return
+		}
+		if req.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "websocket version unsupported", http.StatusUpgradeRequired)
+			return
+		}
+
+		hijacker, ok := w.(http.Hijacker)
+		if ok == false {
+			http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			return
+		}
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+		rw.WriteString("Upgrade: websocket\r\n")
+		rw.WriteString("Connection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+		err = rw.Flush()
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		accept(&wsConn{conn: conn, reader: rw.Reader})
+	})
+}
+
+// tunnel through an http proxy by CONNECT
+func dialProxy(proxy *url.URL, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxy.Host, WS_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(WS_DIAL_TIMEOUT))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic " + auth)
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s CONNECT %s fail, %s", proxy.Host, addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// the proxy may send on right behind its answer, what the reader took
+// in with the answer is read first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn)Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// connect to a ws:// or wss:// address, through the proxy when one is
+// given; a wss certificate is not verified for the same reason as the
+// tls stream
+func DialWebSocket(rawurl string, proxy *url.URL) (FrameConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	if proxy != nil {
+		conn, err = dialProxy(proxy, addr)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, WS_DIAL_TIMEOUT)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(WS_DIAL_TIMEOUT))
+
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: true})
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake with %s fail, %s", addr, err.Error())
+		}
+		conn = tlsConn
+	}
+
+	var nonce [16]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	path := u.RequestURI()
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Opaque: path},
+		Host:   u.Host,
+		Header: make(http.Header),
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket upgrade %s fail, %s", rawurl, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, reader: reader, client: true}, nil
+}
@@ -0,0 +1,48 @@
+package stream
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// the proxy answers and sends on with the same write, the tunnel must
+// not lose what came behind the answer
+func TestDialProxyBuffered(t *testing.T)  {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect || req.Host != "transfer:443" {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nbehind the answer"))
+	}()
+
+	conn, err := dialProxy(&url.URL{Scheme: "http", Host: ln.Addr().String()}, "transfer:443")
+	if err != nil {
+		t.Fatalf("dial proxy fail, %s", err.Error())
+	}
+	defer conn.Close()
+
+	body, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read tunnel fail, %s", err.Error())
+	}
+	if string(body) != "behind the answer" {
+		t.Errorf("tunnel read %q, want %q", string(body), "behind the answer")
+	}
+}
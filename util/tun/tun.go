@@ -1,11 +1,23 @@
 package tun
 
+import (
+	"github.com/easymesh/easymesh/util/ip"
+	"net"
+)
+
 type TunApi interface {
 	Write (p []byte ) error
 	Read  (p []byte) (n int, err error)
 	Close() error
+
+	AddRoute(ipn ip.IP4Net) error
+	DelRoute(ipn ip.IP4Net) error
+
+	AddAddr6(ipn *net.IPNet) error
 }
 
 const (
-	encapOverhead = 28 // 20 bytes IP hdr + 8 bytes UDP hdr
+	// 40 bytes IPv6 hdr + 8 bytes UDP hdr + 10 bytes frame hdr + 28 bytes AEAD nonce and tag,
+	// sized for the ipv6 underlay as ipv6 paths are preferred
+	encapOverhead = 86
 )
\ No newline at end of file
@@ -6,6 +6,7 @@ import (
 	"github.com/easymesh/easymesh/util/ip"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
+	"net"
 	"os"
 	"syscall"
 	"unsafe"
@@ -60,6 +61,57 @@ func (tun *tunLinux)Close() error {
 	return nil
 }
 
+func (tun *tunLinux)AddRoute(ipn ip.IP4Net) error {
+	iface, err := netlink.LinkByName(tun.ifname)
+	if err != nil {
+		return fmt.Errorf("failed to lookup interface %v", tun.ifname)
+	}
+	return addRoute(iface, ipn)
+}
+
+func (tun *tunLinux)DelRoute(ipn ip.IP4Net) error {
+	iface, err := netlink.LinkByName(tun.ifname)
+	if err != nil {
+		return fmt.Errorf("failed to lookup interface %v", tun.ifname)
+	}
+
+	err = netlink.RouteDel(&netlink.Route{
+		LinkIndex: iface.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       ipn.Network().ToIPNet(),
+	})
+	if err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("failed to del route (%v -> %v): %v", ipn.Network().String(), tun.ifname, err)
+	}
+	return nil
+}
+
+// the address prefix becomes an on-link route of the tun
+func (tun *tunLinux)AddAddr6(ipn *net.IPNet) error {
+	iface, err := netlink.LinkByName(tun.ifname)
+	if err != nil {
+		return fmt.Errorf("failed to lookup interface %v", tun.ifname)
+	}
+
+	err = netlink.AddrAdd(iface, &netlink.Addr{IPNet: ipn, Flags: unix.IFA_F_NODAD})
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add IPv6 address %v to %v: %v", ipn.String(), tun.ifname, err)
+	}
+	return nil
+}
+
+func addRoute(iface netlink.Link, ipn ip.IP4Net) error {
+	err := netlink.RouteAdd(&netlink.Route{
+		LinkIndex: iface.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       ipn.Network().ToIPNet(),
+	})
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add route (%v -> %v): %v", ipn.Network().String(), iface.Attrs().Name, err)
+	}
+	return nil
+}
+
 func OpenTun(ifname string, ipnet ip.IP4Net) (TunApi, error) {
 	iface, err := ip.InterfaceByName(ifname)
 	if err != nil {
@@ -125,14 +177,5 @@ func configureIface(ifname string, ipn ip.IP4Net, mtu int) error {
 
 	// explicitly add a route since there might be a route for a subnet already
 	// installed by Docker and then it won't get auto added
-	err = netlink.RouteAdd(&netlink.Route{
-		LinkIndex: iface.Attrs().Index,
-		Scope:     netlink.SCOPE_UNIVERSE,
-		Dst:       ipn.Network().ToIPNet(),
-	})
-	if err != nil && err != syscall.EEXIST {
-		return fmt.Errorf("failed to add route (%v -> %v): %v", ipn.Network().String(), ifname, err)
-	}
-
-	return nil
+	return addRoute(iface, ipn)
 }
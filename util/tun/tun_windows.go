@@ -1,9 +1,12 @@
 package tun
 
 import (
+	"fmt"
 	"github.com/astaxie/beego/logs"
 	"github.com/easymesh/easymesh/util/ip"
 	"golang.org/x/sys/windows"
+	"net"
+	"os/exec"
 )
 
 const WIN_TUN_DHCP_LEASE_TIME = 365*24*3600
@@ -126,11 +129,55 @@ func (tun *TunWin)Close() error {
 	return windows.CloseHandle(tun.FD)
 }
 
+// the tap driver only answers for the configured network, so routes
+// beyond it go through a next hop inside the overlay network
+func (tun *TunWin)nextHop() ip.IP4 {
+	hop := tun.ipnet.Network().IP + 1
+	if hop == tun.ipnet.IP {
+		hop++
+	}
+	return hop
+}
+
+func (tun *TunWin)netsh(action string, ipn ip.IP4Net) error {
+	cmd := exec.Command("netsh", "interface", "ipv4", action, "route",
+		fmt.Sprintf("prefix=%s", ipn.Network().String()),
+		fmt.Sprintf("interface=%s", tun.GetNetworkName(false)),
+		fmt.Sprintf("nexthop=%s", tun.nextHop().String()),
+		"store=active")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("netsh %s route %s fail, %s %s", action, ipn.String(), err.Error(), string(output))
+	}
+	return nil
+}
+
+func (tun *TunWin)AddRoute(ipn ip.IP4Net) error {
+	return tun.netsh("add", ipn)
+}
+
+func (tun *TunWin)DelRoute(ipn ip.IP4Net) error {
+	return tun.netsh("delete", ipn)
+}
+
+func (tun *TunWin)AddAddr6(ipn *net.IPNet) error {
+	cmd := exec.Command("netsh", "interface", "ipv6", "add", "address",
+		fmt.Sprintf("interface=%s", tun.GetNetworkName(false)),
+		fmt.Sprintf("address=%s", ipn.String()),
+		"store=active")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("netsh add address %s fail, %s %s", ipn.String(), err.Error(), string(output))
+	}
+	return nil
+}
+
 func OpenTun(ifname string, ipnet ip.IP4Net) (TunApi, error) {
 	wtun, err := openTun(ipnet.IP.ToIP(), ipnet.NetworkToIP(), ipnet.MaskToIP())
 	if err != nil {
 		return nil, err
 	}
+	wtun.ipnet = ipnet
 
 	err = wtun.SetDHCPMasq( ipnet.IP.ToIP(), ipnet.MaskToIP(), []byte{0, 0, 0, 0}, WIN_TUN_DHCP_LEASE_TIME)
 	if err != nil {
@@ -3,6 +3,7 @@ package tun
 import (
 	"encoding/binary"
 	"fmt"
+	"github.com/easymesh/easymesh/util/ip"
 	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 	"net"
@@ -46,6 +47,8 @@ type TunWin struct {
 
 	readBody         chan []byte
 	writeBody        chan []byte
+
+	ipnet            ip.IP4Net
 }
 
 func ctl_code(device_type, function, method, access uint32) uint32 {
@@ -0,0 +1,229 @@
+package udp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/easymesh/easymesh/util/crypt"
+	"sync"
+)
+
+// versioned ctrl messages, they replace a ctrl nibble followed by raw
+// json; the header looks the same in every version, so any message is
+// taken apart far enough to tell its version and type
+//
+//	0       1         2      3       4        6
+//	| 0x50  | version | type | flags | length | body
+//
+// a message of a named network carries the network id right after, the
+// length counts the body only
+//
+//	6        7
+//	| id len | id | body
+const (
+	MSG_MARK        = 5 << 4
+	MSG_HEADER      = 6
+	MSG_VERSION     = 1
+	MSG_VERSION_MIN = 1
+	MSG_NETWORK_MAX = 64
+)
+
+type MSG_TYPE byte
+
+const (
+	MSG_REGISTER MSG_TYPE = iota + 1
+	MSG_ROUTE_UPDATE
+	MSG_ROUTE_DELTA
+	MSG_PING
+	MSG_PONG
+	MSG_ERROR
+	MSG_PUNCH
+	MSG_PROBE
+	MSG_REPLICATE
+	MSG_LEASE
+	MSG_LEAVE
+)
+
+func (t MSG_TYPE)String() string {
+	switch t {
+	case MSG_REGISTER:return "register"
+	case MSG_ROUTE_UPDATE:return "route update"
+	case MSG_ROUTE_DELTA:return "route delta"
+	case MSG_PING:return "ping"
+	case MSG_PONG:return "pong"
+	case MSG_ERROR:return "error"
+	case MSG_PUNCH:return "punch"
+	case MSG_PROBE:return "probe"
+	case MSG_REPLICATE:return "replicate"
+	case MSG_LEASE:return "lease"
+	case MSG_LEAVE:return "leave"
+	default:
+		return fmt.Sprintf("type %d", byte(t))
+	}
+}
+
+// the body is an auth envelope over header and body
+const MSG_FLAG_AUTH = 0x01
+
+// the header carries the id of the network the message belongs to
+const MSG_FLAG_NET = 0x02
+
+// a ctrl message taken apart, version zero is the deprecated format;
+// the network is empty for the namespace of the port
+type Msg struct {
+	Version byte
+	Type    MSG_TYPE
+	Flags   byte
+	Network string
+	Body    []byte
+
+	header []byte
+}
+
+func (m *Msg)Legacy() bool {
+	return m.Version == 0
+}
+
+func msgHeader(typ MSG_TYPE, flags byte, network string, length int) []byte {
+	if network != "" {
+		flags |= MSG_FLAG_NET
+	}
+	header := make([]byte, MSG_HEADER, MSG_HEADER + 1 + len(network))
+	header[0] = MSG_MARK
+	header[1] = MSG_VERSION
+	header[2] = byte(typ)
+	header[3] = flags
+	binary.BigEndian.PutUint16(header[4:], uint16(length))
+	if network != "" {
+		header = append(header, byte(len(network)))
+		header = append(header, network...)
+	}
+	return header
+}
+
+// an authenticated message in the format the receiver speaks, the
+// network id is covered by the auth as well; the deprecated format knows
+// of no networks
+func MsgAuthCoder(key []byte, version byte, network string, typ MSG_TYPE, body []byte) []byte {
+	return MsgAuthSeqCoder(key, version, network, typ, crypt.NextSequence(), body)
+}
+
+// the sequence number drawn by the caller, for bodies proving a key
+// bound to it
+func MsgAuthSeqCoder(key []byte, version byte, network string, typ MSG_TYPE, seq uint64, body []byte) []byte {
+	if version == 0 {
+		return UdpCtrlType(legacyCtrl(typ), crypt.AuthSeqCoder(key, seq, body))
+	}
+	header := msgHeader(typ, MSG_FLAG_AUTH, network, len(body) + crypt.AUTH_OVERHEAD)
+	return append(header, crypt.AuthSealSeq(key, header, seq, body)...)
+}
+
+func MsgDecoder(buff []byte) (*Msg, error) {
+	if len(buff) < MSG_HEADER || buff[0] != MSG_MARK {
+		return nil, fmt.Errorf("msg header illegal")
+	}
+	msg := &Msg{Version: buff[1], Type: MSG_TYPE(buff[2]), Flags: buff[3]}
+	if msg.Version < MSG_VERSION_MIN {
+		return nil, fmt.Errorf("msg version %d is deprecated", msg.Version)
+	}
+
+	size := MSG_HEADER
+	if msg.Flags & MSG_FLAG_NET != 0 {
+		if len(buff) < size + 1 {
+			return nil, fmt.Errorf("msg %s network id truncated", msg.Type.String())
+		}
+		n := int(buff[size])
+		if n == 0 || n > MSG_NETWORK_MAX || len(buff) < size + 1 + n {
+			return nil, fmt.Errorf("msg %s network id illegal", msg.Type.String())
+		}
+		msg.Network = string(buff[size + 1:size + 1 + n])
+		size += 1 + n
+	}
+	msg.header = buff[:size]
+
+	length := int(binary.BigEndian.Uint16(buff[4:]))
+	if length > len(buff) - size {
+		return nil, fmt.Errorf("msg %s truncated, %d out of %d bytes", msg.Type.String(), len(buff) - size, length)
+	}
+	msg.Body = buff[size:size + length]
+	return msg, nil
+}
+
+// ctrl messages in either format; the deprecated one has a single type
+// for route messages both ways, the receiver tells what they mean
+func CtrlMsgDecoder(buff []byte, route MSG_TYPE) (*Msg, error) {
+	if len(buff) > 0 && buff[0] >> 4 == 0 {
+		typ := legacyMsg(CtrlType(buff[0]))
+		if typ == 0 {
+			return nil, fmt.Errorf("deprecated ctrl type %d unknown", CtrlType(buff[0]))
+		}
+		if typ == MSG_REGISTER {
+			typ = route
+		}
+		return &Msg{Type: typ, Flags: MSG_FLAG_AUTH, Body: buff[1:]}, nil
+	}
+	return MsgDecoder(buff)
+}
+
+// the authenticated body and its sequence number
+func (m *Msg)Open(key []byte) ([]byte, uint64, error) {
+	if m.Flags & MSG_FLAG_AUTH == 0 {
+		return nil, 0, fmt.Errorf("msg %s is not authenticated", m.Type.String())
+	}
+	if m.Legacy() {
+		return crypt.AuthDecoder(key, m.Body)
+	}
+	return crypt.AuthOpen(key, m.header, m.Body)
+}
+
+func legacyCtrl(typ MSG_TYPE) byte {
+	switch typ {
+	case MSG_PUNCH:return CTRL_PUNCH
+	case MSG_PROBE:return CTRL_PROBE
+	case MSG_REPLICATE:return CTRL_REPLICATE
+	case MSG_LEASE:return CTRL_LEASE
+	case MSG_ERROR:return CTRL_ERROR
+	default:
+		return CTRL_ROUTE
+	}
+}
+
+func legacyMsg(ctrl byte) MSG_TYPE {
+	switch ctrl {
+	case CTRL_ROUTE:return MSG_REGISTER
+	case CTRL_PUNCH:return MSG_PUNCH
+	case CTRL_PROBE:return MSG_PROBE
+	case CTRL_REPLICATE:return MSG_REPLICATE
+	case CTRL_LEASE:return MSG_LEASE
+	case CTRL_ERROR:return MSG_ERROR
+	default:
+		return 0
+	}
+}
+
+// senders still speaking the deprecated format, each one is reported
+// once; source addresses are not authenticated yet, the record starts
+// over when it is full so spoofed ones can not grow it
+const LEGACY_PEERS_MAX = 1024
+
+type LegacyPeers struct {
+	sync.Mutex
+	seen map[string]bool
+}
+
+func NewLegacyPeers() *LegacyPeers {
+	return &LegacyPeers{seen: make(map[string]bool, 64)}
+}
+
+func (l *LegacyPeers)First(addr string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.seen[addr] {
+		return false
+	}
+	if len(l.seen) >= LEGACY_PEERS_MAX {
+		l.seen = make(map[string]bool, 64)
+	}
+	l.seen[addr] = true
+	return true
+}
@@ -0,0 +1,187 @@
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/easymesh/easymesh/util/crypt"
+	"testing"
+)
+
+func TestMsgCoder(t *testing.T)  {
+	key := crypt.AuthKey("token")
+
+	cases := []struct {
+		name    string
+		version byte
+		network string
+		typ     MSG_TYPE
+		body    []byte
+		// the deprecated format has one type for route messages both ways
+		want    MSG_TYPE
+	}{
+		{"register", MSG_VERSION, "", MSG_REGISTER, []byte("{}"), MSG_REGISTER},
+		{"empty body", MSG_VERSION, "", MSG_LEAVE, nil, MSG_LEAVE},
+		{"network", MSG_VERSION, "office", MSG_PING, []byte("ping"), MSG_PING},
+		{"longest network", MSG_VERSION, string(bytes.Repeat([]byte("n"), MSG_NETWORK_MAX)), MSG_PUNCH, []byte("punch"), MSG_PUNCH},
+		{"large body", MSG_VERSION, "office", MSG_ROUTE_UPDATE, bytes.Repeat([]byte{0xaa}, 4000), MSG_ROUTE_UPDATE},
+		{"legacy register", 0, "", MSG_REGISTER, []byte("{}"), MSG_ROUTE_UPDATE},
+		{"legacy route delta", 0, "", MSG_ROUTE_DELTA, []byte("{}"), MSG_ROUTE_UPDATE},
+		{"legacy lease", 0, "", MSG_LEASE, []byte("{}"), MSG_LEASE},
+		{"legacy error", 0, "", MSG_ERROR, []byte("{}"), MSG_ERROR},
+	}
+
+	for i, c := range cases {
+		seq := uint64(1000 + i)
+		buff := MsgAuthSeqCoder(key, c.version, c.network, c.typ, seq, c.body)
+
+		msg, err := CtrlMsgDecoder(buff, MSG_ROUTE_UPDATE)
+		if err != nil {
+			t.Errorf("%s: decode fail, %s", c.name, err.Error())
+			continue
+		}
+		if msg.Version != c.version || msg.Type != c.want || msg.Network != c.network {
+			t.Errorf("%s: got version %d type %s network %q, want %d %s %q", c.name,
+				msg.Version, msg.Type.String(), msg.Network, c.version, c.want.String(), c.network)
+		}
+
+		body, got, err := msg.Open(key)
+		if err != nil {
+			t.Errorf("%s: open fail, %s", c.name, err.Error())
+			continue
+		}
+		if bytes.Equal(body, c.body) == false || got != seq {
+			t.Errorf("%s: got body %d bytes sequence %d, want %d bytes %d", c.name, len(body), got, len(c.body), seq)
+		}
+
+		_, _, err = msg.Open(crypt.AuthKey("other"))
+		if err == nil {
+			t.Errorf("%s: opened with another key", c.name)
+		}
+	}
+}
+
+// the header and the network id are covered by the auth
+func TestMsgTampered(t *testing.T)  {
+	key := crypt.AuthKey("token")
+	buff := MsgAuthSeqCoder(key, MSG_VERSION, "office", MSG_REGISTER, 1, []byte("{}"))
+
+	cases := []struct {
+		name string
+		pos  int
+	}{
+		{"type", 2},
+		{"network id", MSG_HEADER + 1},
+		{"body", MSG_HEADER + 1 + len("office") + 16},
+		{"mac", len(buff) - 1},
+	}
+
+	for _, c := range cases {
+		output := append([]byte{}, buff...)
+		output[c.pos] ^= 0x01
+
+		msg, err := MsgDecoder(output)
+		if err != nil {
+			continue
+		}
+		_, _, err = msg.Open(key)
+		if err == nil {
+			t.Errorf("%s: tampered message opened", c.name)
+		}
+	}
+}
+
+func msgBuff(flags byte, length int, tail ...byte) []byte {
+	buff := []byte{MSG_MARK, MSG_VERSION, byte(MSG_REGISTER), flags, 0, 0}
+	binary.BigEndian.PutUint16(buff[4:], uint16(length))
+	return append(buff, tail...)
+}
+
+func TestMsgDecoderIllegal(t *testing.T)  {
+	cases := []struct {
+		name string
+		buff []byte
+	}{
+		{"empty", nil},
+		{"short header", msgBuff(0, 0)[:MSG_HEADER - 1]},
+		{"wrong mark", append([]byte{0x60}, msgBuff(0, 0)[1:]...)},
+		{"version 0", append([]byte{MSG_MARK, 0}, msgBuff(0, 0)[2:]...)},
+		{"network id length missing", msgBuff(MSG_FLAG_NET, 0)},
+		{"network id length 0", msgBuff(MSG_FLAG_NET, 0, 0)},
+		{"network id too long", msgBuff(MSG_FLAG_NET, 0, append([]byte{MSG_NETWORK_MAX + 1}, bytes.Repeat([]byte("n"), MSG_NETWORK_MAX + 1)...)...)},
+		{"network id truncated", msgBuff(MSG_FLAG_NET, 0, 4, 'n', 'e', 't')},
+		{"body truncated", msgBuff(0, 3, 'a', 'b')},
+		{"body truncated after network", msgBuff(MSG_FLAG_NET, 1, 1, 'n')},
+	}
+
+	for _, c := range cases {
+		_, err := MsgDecoder(c.buff)
+		if err == nil {
+			t.Errorf("%s: decoded %v", c.name, c.buff)
+		}
+	}
+}
+
+// every cut of a message short of its length is refused, whatever part
+// of the header or body it falls in
+func TestMsgDecoderTruncated(t *testing.T)  {
+	key := crypt.AuthKey("token")
+
+	for _, network := range []string{"", "office"} {
+		buff := MsgAuthSeqCoder(key, MSG_VERSION, network, MSG_REGISTER, 1, []byte("{}"))
+		for n := 0; n < len(buff); n++ {
+			_, err := MsgDecoder(buff[:n])
+			if err == nil {
+				t.Errorf("network %q: message cut at %d of %d bytes decoded", network, n, len(buff))
+			}
+		}
+		_, err := MsgDecoder(buff)
+		if err != nil {
+			t.Errorf("network %q: full message decode fail, %s", network, err.Error())
+		}
+	}
+}
+
+func TestCtrlMsgDecoderLegacy(t *testing.T)  {
+	cases := []struct {
+		name string
+		buff []byte
+		want MSG_TYPE
+		ok   bool
+	}{
+		{"route", []byte{CTRL_ROUTE, '{', '}'}, MSG_ROUTE_DELTA, true},
+		{"punch", []byte{CTRL_PUNCH}, MSG_PUNCH, true},
+		{"probe", []byte{CTRL_PROBE}, MSG_PROBE, true},
+		{"unknown", []byte{0x0f}, 0, false},
+	}
+
+	for _, c := range cases {
+		msg, err := CtrlMsgDecoder(c.buff, MSG_ROUTE_DELTA)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v, want ok %v", c.name, err, c.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if msg.Legacy() == false || msg.Type != c.want || bytes.Equal(msg.Body, c.buff[1:]) == false {
+			t.Errorf("%s: got version %d type %s", c.name, msg.Version, msg.Type.String())
+		}
+	}
+}
+
+func TestLegacyPeers(t *testing.T)  {
+	l := NewLegacyPeers()
+
+	if l.First("10.0.0.1:8000") == false || l.First("10.0.0.1:8000") {
+		t.Errorf("sender reported more than once")
+	}
+
+	// a full record starts over instead of growing
+	for i := 0; i < LEGACY_PEERS_MAX * 2; i++ {
+		l.First(fmt.Sprintf("10.1.%d.%d:8000", i / 256, i % 256))
+		if len(l.seen) > LEGACY_PEERS_MAX {
+			t.Fatalf("record grows to %d senders", len(l.seen))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// datagram transport between gateways and transfers; the address is
+// whatever the transport tells the far end by, a udp address for the
+// udp socket, a stream address for the streams of util/stream
+type Transport interface {
+	WriteTo(body []byte, dstAddr net.Addr) error
+	ReadFrom(buff []byte) (int, net.Addr, error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+	LocalAddrs() []*net.UDPAddr
+}
+
+type udpTransport struct {
+	conn *net.UDPConn
+}
+
+func NewUdpTransport(conn *net.UDPConn) Transport {
+	return &udpTransport{conn: conn}
+}
+
+func ListenTransport(bindAddr string) (Transport, error) {
+	conn, err := OpenUdp(bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewUdpTransport(conn), nil
+}
+
+func (u *udpTransport)WriteTo(body []byte, dstAddr net.Addr) error {
+	udpAddr, ok := dstAddr.(*net.UDPAddr)
+	if ok == false || udpAddr == nil {
+		return fmt.Errorf("udp can not send to %v", dstAddr)
+	}
+	return UdpWrite(u.conn, udpAddr, body)
+}
+
+func (u *udpTransport)ReadFrom(buff []byte) (int, net.Addr, error) {
+	cnt, addr, err := u.conn.ReadFromUDP(buff)
+	if err != nil {
+		return cnt, nil, err
+	}
+	return cnt, addr, nil
+}
+
+func (u *udpTransport)SetReadDeadline(t time.Time) error {
+	return u.conn.SetReadDeadline(t)
+}
+
+func (u *udpTransport)Close() error {
+	return u.conn.Close()
+}
+
+func (u *udpTransport)LocalAddrs() []*net.UDPAddr {
+	return []*net.UDPAddr{u.conn.LocalAddr().(*net.UDPAddr)}
+}
@@ -30,18 +30,26 @@ func UdpWrite(conn *net.UDPConn, dstAddr *net.UDPAddr, body []byte ) error {
 	return nil
 }
 
-func UdpCtrl(body []byte) []byte {
+// deprecated ctrl format, the type is the low nibble of the first byte
+// and json follows; see msg.go for the versioned messages
+const (
+	CTRL_ROUTE = 0
+	CTRL_PUNCH = 1
+	CTRL_PROBE = 2
+	CTRL_REPLICATE = 3
+	CTRL_LEASE = 4
+	CTRL_ERROR = 5
+)
+
+func UdpCtrlType(typ byte, body []byte) []byte {
 	output := make([]byte, len(body) + 1)
-	output[0] = 0
+	output[0] = typ & 0x0f
 	copy(output[1:], body)
 	return output
 }
 
-func UdpPing(body []byte) []byte {
-	output := make([]byte, len(body) + 1)
-	output[0] = 1 << 4
-	copy(output[1:], body)
-	return output
+func CtrlType(buff byte) byte {
+	return buff & 0x0f
 }
 
 func UnusedPort() int {
@@ -49,7 +57,7 @@ func UnusedPort() int {
 	end := 50000
 	for  {
 		port := begin + (rand.Int() % (end - begin))
-		udpconn, err := OpenUdp(fmt.Sprintf("0.0.0.0:%d", port))
+		udpconn, err := OpenUdp(fmt.Sprintf(":%d", port))
 		if err != nil {
 			continue
 		}